@@ -0,0 +1,433 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// ErrGroupActive 消费组还有在线成员, 不能重置 offset
+var ErrGroupActive = errors.New("kafka consumer group has active members")
+
+// PartitionInfo 分区信息, Oldest/HighWaterMark 为最早和下一条写入的 offset
+type PartitionInfo struct {
+	Topic         string
+	Partition     int32
+	Leader        int32
+	Replicas      []int32
+	Isr           []int32
+	Oldest        int64
+	HighWaterMark int64
+}
+
+// GroupMember 消费组成员
+type GroupMember struct {
+	MemberId   string
+	ClientId   string
+	ClientHost string
+}
+
+// GroupInfo 消费组信息, State 为 Empty 时没有在线成员
+type GroupInfo struct {
+	GroupId      string
+	State        string
+	ProtocolType string
+	Protocol     string
+	Members      []GroupMember
+}
+
+// GroupOffset 消费组在分区上已提交的 offset, 未提交时 Committed 为 -1, 此时 Lag 按 Oldest 计算
+type GroupOffset struct {
+	Partition     int32
+	Committed     int64
+	HighWaterMark int64
+	Lag           int64
+}
+
+// KafAdmin kafka 管理接口, 并发安全, 需要 kafka 0.10.1 及以上版本
+type KafAdmin struct {
+	Addr    []string
+	Conf    *sarama.Config
+	Timeout time.Duration // 创建/删除 topic 的等待时间, 默认 30s
+
+	mu     sync.Mutex
+	client sarama.Client
+}
+
+func (a *KafAdmin) getClient() (sarama.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client == nil {
+		if a.Conf == nil {
+			a.Conf = sarama.NewConfig()
+			a.Conf.Version = sarama.V0_11_0_0
+		}
+		client, err := sarama.NewClient(a.Addr, a.Conf)
+		if err != nil {
+			return nil, err
+		}
+		a.client = client
+	}
+	return a.client, nil
+}
+
+func (a *KafAdmin) timeout() time.Duration {
+	if a.Timeout > 0 {
+		return a.Timeout
+	}
+	return 30 * time.Second
+}
+
+// Close 关闭底层 client
+func (a *KafAdmin) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client == nil {
+		return nil
+	}
+	err := a.client.Close()
+	a.client = nil
+	return err
+}
+
+// CreateTopic 创建 topic, configs 为 topic 级别配置(如 retention.ms), 可为空
+func (a *KafAdmin) CreateTopic(topic string, partitions int32, replication int16, configs map[string]string) error {
+	client, err := a.getClient()
+	if err != nil {
+		return err
+	}
+	controller, err := client.Controller()
+	if err != nil {
+		return err
+	}
+
+	detail := &sarama.TopicDetail{NumPartitions: partitions, ReplicationFactor: replication}
+	if len(configs) > 0 {
+		detail.ConfigEntries = make(map[string]*string, len(configs))
+		for k, v := range configs {
+			v := v
+			detail.ConfigEntries[k] = &v
+		}
+	}
+	resp, err := controller.CreateTopics(&sarama.CreateTopicsRequest{
+		TopicDetails: map[string]*sarama.TopicDetail{topic: detail},
+		Timeout:      a.timeout(),
+	})
+	if err != nil {
+		return err
+	}
+	if terr, ok := resp.TopicErrors[topic]; ok && terr.Err != sarama.ErrNoError {
+		if terr.ErrMsg != nil {
+			return fmt.Errorf("kafka create topic:%s error:%v %s", topic, terr.Err, *terr.ErrMsg)
+		}
+		return fmt.Errorf("kafka create topic:%s error:%v", topic, terr.Err)
+	}
+	return client.RefreshMetadata(topic)
+}
+
+// DeleteTopic 删除 topic, 需要 broker 开启 delete.topic.enable
+func (a *KafAdmin) DeleteTopic(topic string) error {
+	client, err := a.getClient()
+	if err != nil {
+		return err
+	}
+	controller, err := client.Controller()
+	if err != nil {
+		return err
+	}
+	resp, err := controller.DeleteTopics(&sarama.DeleteTopicsRequest{
+		Topics:  []string{topic},
+		Timeout: a.timeout(),
+	})
+	if err != nil {
+		return err
+	}
+	if kerr, ok := resp.TopicErrorCodes[topic]; ok && kerr != sarama.ErrNoError {
+		return fmt.Errorf("kafka delete topic:%s error:%v", topic, kerr)
+	}
+	return nil
+}
+
+// Topics 返回所有 topic
+func (a *KafAdmin) Topics() ([]string, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
+	if err := client.RefreshMetadata(); err != nil {
+		return nil, err
+	}
+	return client.Topics()
+}
+
+// Partitions 返回 topic 所有分区的副本和 offset 范围
+func (a *KafAdmin) Partitions(topic string) ([]PartitionInfo, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]PartitionInfo, 0, len(partitions))
+	for _, p := range partitions {
+		info := PartitionInfo{Topic: topic, Partition: p, Leader: -1}
+		if leader, err := client.Leader(topic, p); err == nil {
+			info.Leader = leader.ID()
+		}
+		if info.Replicas, err = client.Replicas(topic, p); err != nil {
+			return nil, err
+		}
+		if info.Isr, err = client.InSyncReplicas(topic, p); err != nil {
+			return nil, err
+		}
+		if info.Oldest, err = client.GetOffset(topic, p, sarama.OffsetOldest); err != nil {
+			return nil, err
+		}
+		if info.HighWaterMark, err = client.GetOffset(topic, p, sarama.OffsetNewest); err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ListGroups 返回所有消费组及其协议类型(kafka 消费组为 consumer)
+func (a *KafAdmin) ListGroups() (map[string]string, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]string)
+	for _, broker := range client.Brokers() {
+		if err := a.open(broker); err != nil {
+			return nil, err
+		}
+		resp, err := broker.ListGroups(&sarama.ListGroupsRequest{})
+		if err != nil {
+			return nil, err
+		}
+		if resp.Err != sarama.ErrNoError {
+			return nil, fmt.Errorf("kafka list groups broker:%s error:%v", broker.Addr(), resp.Err)
+		}
+		for group, protocolType := range resp.Groups {
+			groups[group] = protocolType
+		}
+	}
+	return groups, nil
+}
+
+// DescribeGroup 返回消费组状态和成员
+func (a *KafAdmin) DescribeGroup(group string) (*GroupInfo, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := coordinator.DescribeGroups(&sarama.DescribeGroupsRequest{Groups: []string{group}})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Groups) == 0 {
+		return nil, fmt.Errorf("kafka describe group:%s empty response", group)
+	}
+	desc := resp.Groups[0]
+	if desc.Err != sarama.ErrNoError {
+		return nil, fmt.Errorf("kafka describe group:%s error:%v", group, desc.Err)
+	}
+
+	info := &GroupInfo{
+		GroupId:      desc.GroupId,
+		State:        desc.State,
+		ProtocolType: desc.ProtocolType,
+		Protocol:     desc.Protocol,
+	}
+	for id, m := range desc.Members {
+		info.Members = append(info.Members, GroupMember{MemberId: id, ClientId: m.ClientId, ClientHost: m.ClientHost})
+	}
+	return info, nil
+}
+
+// GroupOffsets 返回消费组在 topic 各分区上已提交的 offset 和积压
+func (a *KafAdmin) GroupOffsets(group, topic string) ([]GroupOffset, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := a.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: group}
+	for _, info := range infos {
+		req.AddPartition(topic, info.Partition)
+	}
+	resp, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]GroupOffset, 0, len(infos))
+	for _, info := range infos {
+		o := GroupOffset{Partition: info.Partition, Committed: -1, HighWaterMark: info.HighWaterMark}
+		if block := resp.GetBlock(topic, info.Partition); block != nil {
+			if block.Err != sarama.ErrNoError {
+				return nil, fmt.Errorf("kafka fetch offset group:%s topic:%s partition:%d error:%v", group, topic, info.Partition, block.Err)
+			}
+			o.Committed = block.Offset
+		}
+		if o.Committed >= 0 {
+			o.Lag = info.HighWaterMark - o.Committed
+		} else {
+			o.Lag = info.HighWaterMark - info.Oldest
+		}
+		offsets = append(offsets, o)
+	}
+	return offsets, nil
+}
+
+// ResetOffsets 把消费组在 topic 所有分区上的 offset 重置到 sarama.OffsetOldest 或 sarama.OffsetNewest,
+// 或者指定的 offset(超出范围时取最近的边界), 返回每个分区重置后的 offset
+// 消费组必须没有在线成员, 否则返回 ErrGroupActive
+func (a *KafAdmin) ResetOffsets(group, topic string, offset int64) (map[int32]int64, error) {
+	return a.reset(group, topic, func(info PartitionInfo) (int64, error) {
+		switch offset {
+		case sarama.OffsetOldest:
+			return info.Oldest, nil
+		case sarama.OffsetNewest:
+			return info.HighWaterMark, nil
+		}
+		return offset, nil
+	})
+}
+
+// ResetOffsetsToTime 把消费组在 topic 所有分区上的 offset 重置到 t 之后的第一条消息,
+// 没有更新的消息时重置到 HighWaterMark
+func (a *KafAdmin) ResetOffsetsToTime(group, topic string, t time.Time) (map[int32]int64, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
+	ts := t.UnixNano() / int64(time.Millisecond)
+	return a.reset(group, topic, func(info PartitionInfo) (int64, error) {
+		return offsetAt(client, topic, info.Partition, ts)
+	})
+}
+
+// offsetAt 返回分区上时间戳不早于 ts(毫秒) 的第一条消息的 offset, 没有时返回 HighWaterMark
+// ts 也可以是 sarama.OffsetOldest / sarama.OffsetNewest
+func offsetAt(client sarama.Client, topic string, partition int32, ts int64) (int64, error) {
+	offset, err := client.GetOffset(topic, partition, ts)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+	return offset, nil
+}
+
+// CommitOffsets 为消费组提交指定分区的 offset(下一条要消费的消息), 超出范围时取最近的边界
+// 消费组必须没有在线成员, 否则返回 ErrGroupActive
+func (a *KafAdmin) CommitOffsets(group, topic string, offsets map[int32]int64) error {
+	_, err := a.reset(group, topic, func(info PartitionInfo) (int64, error) {
+		offset, ok := offsets[info.Partition]
+		if !ok {
+			return -1, nil
+		}
+		return offset, nil
+	})
+	return err
+}
+
+// reset 按 at 计算每个分区的 offset 并提交, at 返回负数时跳过该分区
+func (a *KafAdmin) reset(group, topic string, at func(info PartitionInfo) (int64, error)) (map[int32]int64, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
+	desc, err := a.DescribeGroup(group)
+	if err != nil {
+		return nil, err
+	}
+	if len(desc.Members) > 0 {
+		return nil, ErrGroupActive
+	}
+	infos, err := a.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &sarama.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           group,
+		ConsumerGroupGeneration: sarama.GroupGenerationUndefined, // 不属于任何一代, 只有空消费组才能提交
+		RetentionTime:           -1,
+	}
+	reset := make(map[int32]int64, len(infos))
+	for _, info := range infos {
+		offset, err := at(info)
+		if err != nil {
+			return nil, err
+		}
+		if offset < 0 {
+			continue
+		}
+		if offset < info.Oldest {
+			offset = info.Oldest
+		}
+		if offset > info.HighWaterMark {
+			offset = info.HighWaterMark
+		}
+		req.AddBlock(topic, info.Partition, offset, 0, "")
+		reset[info.Partition] = offset
+	}
+	if len(reset) == 0 {
+		return reset, nil
+	}
+
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := coordinator.CommitOffset(req)
+	if err != nil {
+		return nil, err
+	}
+	for partition, kerr := range resp.Errors[topic] {
+		if kerr != sarama.ErrNoError {
+			if kerr == sarama.ErrNotCoordinatorForConsumer {
+				client.RefreshCoordinator(group)
+			}
+			return nil, fmt.Errorf("kafka commit offset group:%s topic:%s partition:%d error:%v", group, topic, partition, kerr)
+		}
+	}
+	return reset, nil
+}
+
+// open 连接 client.Brokers() 返回的 broker, 已连接时忽略
+func (a *KafAdmin) open(broker *sarama.Broker) error {
+	if ok, _ := broker.Connected(); ok {
+		return nil
+	}
+	if err := broker.Open(a.Conf); err != nil && err != sarama.ErrAlreadyConnected {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package kafka_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/wthsjy/hswjywtgu2/kafka"
+	"github.com/wthsjy/hswjywtgu2/kafka/kafkatest"
+)
+
+var startTime = time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// newAdminBroker topic_test 有两个分区, group_id 在分区 0 上已提交 20, 分区 1 没有提交
+func newAdminBroker(t *testing.T, members map[string]*sarama.GroupMemberDescription) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("topic_test", 0, broker.BrokerID()).
+			SetLeader("topic_test", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("topic_test", 0, sarama.OffsetOldest, 10).
+			SetOffset("topic_test", 0, sarama.OffsetNewest, 100).
+			SetOffset("topic_test", 1, sarama.OffsetOldest, 0).
+			SetOffset("topic_test", 1, sarama.OffsetNewest, 50).
+			SetOffset("topic_test", 1, startTime.UnixNano()/int64(time.Millisecond), 30),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group_id", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group_id", "topic_test", 0, 20, "", sarama.ErrNoError).
+			SetOffset("group_id", "topic_test", 1, -1, "", sarama.ErrNoError),
+		"DescribeGroupsRequest": sarama.NewMockWrapper(&sarama.DescribeGroupsResponse{
+			Groups: []*sarama.GroupDescription{{GroupId: "group_id", State: "Empty", Members: members}},
+		}),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+	return broker
+}
+
+func TestKafAdmin_ResetOffsets(t *testing.T) {
+	broker := newAdminBroker(t, nil)
+	defer broker.Close()
+
+	admin := &kafka.KafAdmin{Addr: []string{broker.Addr()}}
+	defer admin.Close()
+
+	infos, err := admin.Partitions("topic_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Oldest != 10 || infos[0].HighWaterMark != 100 {
+		t.Fatalf("partitions %+v", infos)
+	}
+
+	reset, err := admin.ResetOffsets("group_id", "topic_test", sarama.OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset[0] != 10 || reset[1] != 0 {
+		t.Fatalf("reset to oldest %v", reset)
+	}
+	reset, err = admin.ResetOffsets("group_id", "topic_test", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset[0] != 60 || reset[1] != 50 {
+		t.Fatalf("reset to 60 %v", reset)
+	}
+}
+
+func TestKafAdmin_ResetActiveGroup(t *testing.T) {
+	broker := newAdminBroker(t, map[string]*sarama.GroupMemberDescription{"m1": {ClientId: "c1"}})
+	defer broker.Close()
+
+	admin := &kafka.KafAdmin{Addr: []string{broker.Addr()}}
+	defer admin.Close()
+
+	if _, err := admin.ResetOffsets("group_id", "topic_test", sarama.OffsetNewest); err != kafka.ErrGroupActive {
+		t.Fatalf("reset active group: %v", err)
+	}
+}
+
+func TestKafComsumer_StartTime(t *testing.T) {
+	active := map[string]*sarama.GroupMemberDescription{"m1": {ClientId: "c1"}}
+	for _, tc := range []struct {
+		name    string
+		members map[string]*sarama.GroupMemberDescription
+		offsets map[string]map[int32]int64
+		want    int64 // 分区 1 提交的起始 offset, -1 表示不提交
+	}{
+		{name: "start time", want: 30},
+		{name: "start offsets", offsets: map[string]map[int32]int64{"topic_test": {0: 5, 1: 45}}, want: 45},
+		{name: "active group", members: active, want: -1},
+	} {
+		broker := newAdminBroker(t, tc.members)
+		b := kafkatest.NewBroker(1)
+		b.Produce("topic_test", nil, []byte("a"), nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c := &kafka.KafComsumer{
+			Addr:         []string{broker.Addr()},
+			Topics:       []string{"topic_test"},
+			GroupId:      "group_id",
+			Handler:      &countHandler{n: 1, cancel: cancel},
+			StartTime:    startTime,
+			StartOffsets: tc.offsets,
+			Dial:         b.Dial,
+		}
+		runConsumer(ctx, t, c, cancel)
+
+		// 加入消费组前只为没有提交过的分区 1 提交起始 offset, 分区 0 已提交 20, 不受影响
+		var commits []*sarama.OffsetCommitRequest
+		for _, rr := range broker.History() {
+			if req, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+				commits = append(commits, req)
+			}
+		}
+		broker.Close()
+		if tc.want < 0 {
+			if len(commits) != 0 {
+				t.Fatalf("%s: committed with active members", tc.name)
+			}
+			continue
+		}
+		if len(commits) != 1 {
+			t.Fatalf("%s: %d commits, want 1", tc.name, len(commits))
+		}
+		if offset, _, err := commits[0].Offset("topic_test", 1); err != nil || offset != tc.want {
+			t.Fatalf("%s: partition 1 committed %d %v, want %d", tc.name, offset, err, tc.want)
+		}
+		if _, _, err := commits[0].Offset("topic_test", 0); err == nil {
+			t.Fatalf("%s: committed partition 0 overwritten", tc.name)
+		}
+	}
+}
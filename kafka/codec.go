@@ -0,0 +1,52 @@
+package kafka
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wthsjy/hswjywtgu2/util/didi_json"
+)
+
+// Codec 消息解码
+type Codec interface {
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec 使用 didi_json.DIDIJSON 解码
+	JSONCodec Codec = jsonCodec{}
+	// ProtoCodec v 需要实现 proto.Message
+	ProtoCodec Codec = protoCodec{}
+	// RawCodec v 需要是 *[]byte 或 *string, 不做任何解码
+	RawCodec Codec = rawCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return didi_json.DIDIJSON.Unmarshal(data, v)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("kafka proto codec: %T is not proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch p := v.(type) {
+	case *[]byte:
+		*p = data
+	case *string:
+		*p = string(data)
+	default:
+		return fmt.Errorf("kafka raw codec: unsupported type %T", v)
+	}
+	return nil
+}
@@ -1,60 +1,703 @@
 package kafka
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/Shopify/sarama"
 	"github.com/bsm/sarama-cluster"
-	"time"
 )
 
 type KafcInterface interface {
 	Process(bs []byte)
 }
 
+// KafcHandler 消息处理接口, 返回 nil 时才会 mark offset, 返回 error 时按 KafComsumer.OnFailure 处理
+type KafcHandler interface {
+	Handle(msg *sarama.ConsumerMessage) error
+}
+
+// KafcBatchHandler 批量处理接口, 返回 nil 后整批 mark offset, 返回 error 时整批按 KafComsumer.OnFailure 处理
+type KafcBatchHandler interface {
+	HandleBatch(msgs []*sarama.ConsumerMessage) error
+}
+
+// Deduplicator 幂等处理钩子, 用于跳过提交 offset 前崩溃导致的重复投递
+type Deduplicator interface {
+	// Seen 返回消息是否已经处理过, 处理过的消息不再交给 Handler, 直接 mark offset
+	Seen(msg *sarama.ConsumerMessage) (bool, error)
+	// Done 消息处理成功后, mark offset 之前调用
+	Done(msg *sarama.ConsumerMessage) error
+}
+
+// FailurePolicy Handler 返回 error 时的处理策略
+type FailurePolicy int
+
+const (
+	// FailRetry 间隔 RetryBackoff 重试, 超过 Retries 次后停止消费
+	FailRetry FailurePolicy = iota
+	// FailSkip 跳过该消息, 照常 mark offset
+	FailSkip
+	// FailStop 停止消费, 不 mark offset, Run 返回 *ProcessError
+	FailStop
+	// FailDeadLetter 重试 Retries 次后把原消息写入 DeadLetterTopic, 然后 mark offset
+	FailDeadLetter
+)
+
+// 死信消息携带的 header
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderError             = "x-error"
+	HeaderAttempts          = "x-attempts"
+)
+
+// ProcessError 消息处理失败
+type ProcessError struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Attempts  int
+	Batch     int // 批量处理时的消息数, Topic/Partition/Offset 为该批第一条消息
+	Err       error
+}
+
+func (e *ProcessError) Error() string {
+	if e.Batch > 0 {
+		return fmt.Sprintf("kafka process topic:%s partition:%d offset:%d batch:%d attempts:%d error:%v",
+			e.Topic, e.Partition, e.Offset, e.Batch, e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("kafka process topic:%s partition:%d offset:%d attempts:%d error:%v",
+		e.Topic, e.Partition, e.Offset, e.Attempts, e.Err)
+}
+
+// ClusterConsumer KafComsumer 用到的 *cluster.Consumer 方法, 测试时可以用 kafkatest 替换
+type ClusterConsumer interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Partitions() <-chan cluster.PartitionConsumer
+	Errors() <-chan error
+	Notifications() <-chan *cluster.Notification
+	MarkOffset(msg *sarama.ConsumerMessage, metadata string)
+	CommitOffsets() error
+	HighWaterMarks() map[string]map[int32]int64
+	Close() error
+}
+
 type KafComsumer struct {
 	Addr    []string
 	Topics  []string
 	GroupId string
 	Conf    *cluster.Config
 	Process KafcInterface
+
+	Handler      KafcHandler   // 不为空时代替 Process
+	OnFailure    FailurePolicy // Handler 失败策略, 默认 FailRetry
+	Retries      int           // 最大重试次数, FailRetry 时 0 表示一直重试
+	RetryBackoff time.Duration // 重试间隔, 默认 1s
+
+	DeadLetterTopic string       // FailDeadLetter 死信 topic
+	DeadLetter      *KafProducer // 死信生产者, 为空时使用 Addr 和 Conf 的连接设置创建
+
+	BatchHandler KafcBatchHandler // 不为空时按批处理, 代替 Handler 和 Process
+	BatchSize    int              // 每批最多消息数, 默认 100
+	BatchWait    time.Duration    // 凑批最长等待时间, 默认 1s
+
+	// Workers 大于 0 时使用 cluster.ConsumerModePartitions 按分区并行消费,
+	// 同一分区内顺序处理, 所有分区同时处理的消息数不超过 Workers
+	Workers int
+
+	// OnError broker 错误回调, transient 为 true 时消费者会继续运行, 为空时打印错误
+	OnError func(err error, transient bool)
+	// Reconnects 非临时错误或连接失败后的最大重连次数, 0 表示一直重连, 小于 0 不重连
+	Reconnects int
+	// ReconnectBackoff 首次重连间隔, 默认 1s, 之后每次翻倍, 最大 MaxReconnectBackoff(默认 30s)
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+
+	// SyncCommit 为 true 时每条消息(批量模式为每批)处理成功后立即同步提交 offset,
+	// 避免 CommitInterval 内崩溃丢失已处理的 offset, 配合 Dedup 实现至少一次且幂等的处理
+	SyncCommit bool
+	Dedup      Deduplicator
+
+	// OnRebalance 每次 rebalance 通知(开始/成功/失败)都会回调, 可用于记录分区归属
+	OnRebalance func(n *cluster.Notification)
+	// OnClaimed rebalance 成功后回调本实例新分配到的分区, current 为当前持有的全部分区
+	OnClaimed func(claimed, current map[string][]int32)
+	// OnReleased rebalance 成功后回调本实例被回收的分区, 回收前 mark 的 offset 已提交;
+	// Workers 模式下会等被回收分区处理中的消息完成后再回调, 但这些消息在分区回收后才 mark,
+	// offset 不会提交, 新分配到该分区的消费者会重新处理
+	OnReleased func(released map[string][]int32)
+
+	// StartAt 没有提交过 offset 的分区从哪里开始消费: sarama.OffsetOldest(默认) 或 sarama.OffsetNewest
+	StartAt int64
+	// StartTime 不为零时, 没有提交过 offset 的分区从该时间之后的第一条消息开始消费, 优先于 StartAt
+	StartTime time.Time
+	// StartOffsets 指定分区(topic -> partition -> offset)的起始 offset, 优先于 StartTime
+	// StartTime/StartOffsets 在加入消费组前通过 Addr 查询并提交, 已提交过 offset 的分区不受影响,
+	// 消费组已有在线成员时不提交(由最先启动的实例提交);
+	// 需要重新消费已提交过的分区时, 先停止消费组再用 KafAdmin.ResetOffsets / ResetOffsetsToTime / CommitOffsets 重置
+	StartOffsets map[string]map[int32]int64
+
+	// Dial 创建底层消费者, 为空时使用 cluster.NewConsumer
+	Dial func(addr []string, groupId string, topics []string, conf *cluster.Config) (ClusterConsumer, error)
+
+	// Metrics 消费指标, 为空时不统计, MetricsInterval 为积压上报间隔, 默认 10s
+	Metrics         Metrics
+	MetricsInterval time.Duration
+
+	// OnPanic Handler panic 时回调, 为空时打印 topic/partition/offset 和堆栈;
+	// panic 会转为 *PanicError 按 OnFailure 处理
+	OnPanic func(err *PanicError)
+
+	// RateLimit 每秒最多处理的消息数, 0 表示不限制
+	RateLimit float64
+
+	dlq     *KafProducer
+	sem     chan struct{}
+	limiter *limiter
+	mu      sync.Mutex
+	offsets map[string]map[int32]int64
+	paused  map[string]map[int32]*pauseState
+}
+
+// processHandler 兼容 KafcInterface, 总是处理成功
+type processHandler struct {
+	KafcInterface
+}
+
+func (h processHandler) Handle(msg *sarama.ConsumerMessage) error {
+	if h.KafcInterface != nil {
+		h.Process(msg.Value)
+	}
+	return nil
 }
 
 func defaultConfig() *cluster.Config {
 	conf := cluster.NewConfig()
 	conf.Group.Return.Notifications = true
+	conf.Consumer.Return.Errors = true
 	conf.Consumer.Offsets.CommitInterval = 1 * time.Second
 	conf.Consumer.Offsets.Initial = sarama.OffsetOldest
 	return conf
 }
 
-// Comsumer kafka 消费
+// deadLetterConfig 默认死信生产者的配置, TLS/SASL、ClientID 和 Version 等连接设置与消费者一致
+func (c *KafComsumer) deadLetterConfig() *sarama.Config {
+	conf := c.Conf.Config
+	conf.Producer.RequiredAcks = sarama.WaitForAll
+	conf.Producer.Retry.Max = 3
+	// 死信消息带原消息的 header, 需要 0.11 及以上版本的协议
+	if !conf.Version.IsAtLeast(sarama.V0_11_0_0) {
+		conf.Version = sarama.V0_11_0_0
+	}
+	return &conf
+}
+
+// Comsumer kafka 消费, 等同于 Run(context.Background())
 func (c *KafComsumer) Comsumer() error {
+	return c.Run(context.Background())
+}
+
+// Run kafka 消费, ctx 取消后停止拉取消息, 等待处理中的消息完成, 提交已 mark 的 offset 后关闭
+// 临时错误只通过 OnError 上报, 其余 broker 错误会断开重连, 重连次数用完后返回最后一次错误
+func (c *KafComsumer) Run(ctx context.Context) error {
 	if c.Conf == nil {
 		c.Conf = defaultConfig()
 	}
-	comsumer, err := cluster.NewConsumer(c.Addr, c.GroupId, c.Topics, c.Conf)
+	if c.OnFailure == FailDeadLetter {
+		if c.DeadLetterTopic == "" {
+			return errors.New("kafka DeadLetterTopic is empty")
+		}
+		c.dlq = c.DeadLetter
+		if c.dlq == nil {
+			c.dlq = &KafProducer{Addr: c.Addr, Conf: c.deadLetterConfig()}
+			defer c.dlq.Close()
+		}
+	}
+
+	if err := c.seek(); err != nil {
+		return err
+	}
+
+	c.sem = nil
+	if c.Workers > 0 {
+		c.Conf.Group.Mode = cluster.ConsumerModePartitions
+		c.sem = make(chan struct{}, c.Workers)
+	}
+
+	c.limiter = nil
+	if c.RateLimit > 0 {
+		c.limiter = newLimiter(c.RateLimit)
+	}
+
+	backoff := c.ReconnectBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := c.MaxReconnectBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	for attempt, wait := 0, backoff; ; {
+		healthy, reconnect, err := c.session(ctx)
+		if err == nil || ctx.Err() != nil {
+			return nil
+		}
+		if !reconnect {
+			return err
+		}
+
+		if healthy {
+			attempt, wait = 0, backoff
+		}
+		attempt++
+		if c.Reconnects < 0 || (c.Reconnects > 0 && attempt > c.Reconnects) {
+			return fmt.Errorf("kafka comsumer give up after %d reconnects: %v", attempt-1, err)
+		}
+
+		fmt.Printf("[WARN] kafka comsumer reconnect %d after %s\n", attempt, wait)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+}
+
+// session 建立一次消费者连接并消费, 直到 ctx 取消或出错
+// healthy 表示本次连接曾成功加入消费组, reconnect 表示错误来自 broker 可以重连
+func (c *KafComsumer) session(ctx context.Context) (healthy, reconnect bool, err error) {
+	comsumer, err := c.dial()
+	if err != nil {
+		if _, ok := err.(sarama.ConfigurationError); ok {
+			return false, false, err
+		}
+		c.reportError(err)
+		return false, true, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	perrs := make(chan error)
+	var wg sync.WaitGroup
+	streams := make(map[string]map[int32]chan struct{})
+	stream := func(msgs <-chan *sarama.ConsumerMessage, done chan struct{}) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			if err := c.consume(ctx, comsumer, msgs); err != nil {
+				select {
+				case errc <- err:
+				default:
+				}
+			}
+		}()
+	}
+
+	c.mu.Lock()
+	c.offsets = nil
+	c.mu.Unlock()
+	if c.Metrics != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.reportLag(ctx, comsumer)
+		}()
+	}
+
+	var partitions <-chan cluster.PartitionConsumer
+	if c.Conf.Group.Mode == cluster.ConsumerModePartitions {
+		partitions = comsumer.Partitions()
+	} else {
+		stream(comsumer.Messages(), make(chan struct{}))
+	}
+
 	defer func() {
-		if comsumer != nil {
-			comsumer.Close()
+		cancel()
+		wg.Wait()
+		if err := comsumer.CommitOffsets(); err != nil {
+			fmt.Printf("[ERROR] commit offsets %s\n", err.Error())
 		}
+		comsumer.Close()
 	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return healthy, false, nil
+		case err := <-errc:
+			return healthy, false, err
+		case err := <-comsumer.Errors():
+			if !c.reportError(err) {
+				return healthy, true, err
+			}
+		case err := <-perrs:
+			if !c.reportError(err) {
+				return healthy, true, err
+			}
+		case n := <-comsumer.Notifications():
+			if n == nil {
+				continue
+			}
+			if n.Type == cluster.RebalanceOK {
+				healthy = true
+			}
+			c.notify(ctx, n, streams)
+		case pc, ok := <-partitions:
+			if !ok {
+				return healthy, false, nil
+			}
+			// 分区被回收时 Messages 会被关闭, 对应的 consume 随之退出
+			go func(pc cluster.PartitionConsumer) {
+				for err := range pc.Errors() {
+					select {
+					case perrs <- err:
+					case <-ctx.Done():
+					}
+				}
+			}(pc)
+			if offset := pc.InitialOffset(); offset >= 0 {
+				c.position(pc.Topic(), pc.Partition(), offset, true)
+			}
+			done := make(chan struct{})
+			if streams[pc.Topic()] == nil {
+				streams[pc.Topic()] = make(map[int32]chan struct{})
+			}
+			streams[pc.Topic()][pc.Partition()] = done
+			stream(pc.Messages(), done)
+		}
+	}
+}
+
+// notify 回调 rebalance 相关钩子, streams 为 Workers 模式下各分区 consume 的结束信号
+func (c *KafComsumer) notify(ctx context.Context, n *cluster.Notification, streams map[string]map[int32]chan struct{}) {
+	if c.OnRebalance != nil {
+		c.OnRebalance(n)
+	}
+	if n.Type != cluster.RebalanceOK {
+		return
+	}
+
+	for topic, partitions := range n.Released {
+		for _, p := range partitions {
+			// 被回收的分区不再等待 Resume, 暂停中持有的消息交给新的消费者处理
+			c.unpause(topic, p, true)
+			c.forget(topic, p)
+
+			done, ok := streams[topic][p]
+			if !ok {
+				continue
+			}
+			delete(streams[topic], p)
+			if c.OnReleased != nil {
+				select {
+				case <-done:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}
+	if c.OnReleased != nil && hasPartitions(n.Released) {
+		c.OnReleased(n.Released)
+	}
+	if c.OnClaimed != nil && hasPartitions(n.Claimed) {
+		c.OnClaimed(n.Claimed, n.Current)
+	}
+}
+
+func hasPartitions(m map[string][]int32) bool {
+	for _, partitions := range m {
+		if len(partitions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *KafComsumer) dial() (ClusterConsumer, error) {
+	if c.Dial != nil {
+		return c.Dial(c.Addr, c.GroupId, c.Topics, c.Conf)
+	}
+	comsumer, err := cluster.NewConsumer(c.Addr, c.GroupId, c.Topics, c.Conf)
 	if err != nil {
-		fmt.Println(err.Error())
-		return err
+		return nil, err
+	}
+	return comsumer, nil
+}
+
+// reportError 通过 OnError 上报 broker 错误, 返回是否为临时错误
+func (c *KafComsumer) reportError(err error) bool {
+	var topic string
+	if e, ok := err.(*sarama.ConsumerError); ok {
+		topic = e.Topic
 	}
+	c.metrics().Error(topic, ErrorBroker)
+
+	transient := IsTransient(err)
+	if c.OnError != nil {
+		c.OnError(err, transient)
+	} else {
+		fmt.Printf("[ERROR] transient:%v %s\n", transient, err.Error())
+	}
+	return transient
+}
 
+// consume 处理 msgs, ctx 取消后不再取新消息
+func (c *KafComsumer) consume(ctx context.Context, comsumer ClusterConsumer, msgs <-chan *sarama.ConsumerMessage) error {
+	if c.BatchHandler != nil {
+		return c.consumeBatch(ctx, comsumer, msgs)
+	}
+
+	var h KafcHandler = processHandler{c.Process}
+	if c.Handler != nil {
+		h = c.Handler
+	}
 	for {
 		select {
-		case err := <-comsumer.Errors():
-			fmt.Printf("[ERROR] %s\n", err.Error())
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			c.received(msg)
+			if !c.waitResume(ctx, msg.Topic, msg.Partition) {
+				continue
+			}
+			batch := []*sarama.ConsumerMessage{msg}
+			if err := c.process(ctx, comsumer, batch, func(msgs []*sarama.ConsumerMessage) error {
+				return h.Handle(msgs[0])
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// consumeBatch 攒够 BatchSize 条或等待 BatchWait 后交给 BatchHandler
+func (c *KafComsumer) consumeBatch(ctx context.Context, comsumer ClusterConsumer, msgs <-chan *sarama.ConsumerMessage) error {
+	size := c.BatchSize
+	if size <= 0 {
+		size = 100
+	}
+	wait := c.BatchWait
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	var batch []*sarama.ConsumerMessage
+	var timeout <-chan time.Time
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		b := batch
+		batch, timeout = nil, nil
+		return c.process(ctx, comsumer, b, c.BatchHandler.HandleBatch)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// 未处理的消息没有 mark, 重启后会重新消费
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return flush()
+			}
+			c.received(msg)
+			if c.Paused(msg.Topic, msg.Partition) {
+				if err := flush(); err != nil {
+					return err
+				}
+				if !c.waitResume(ctx, msg.Topic, msg.Partition) {
+					continue
+				}
+			}
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				timeout = time.After(wait)
+			}
+			if len(batch) >= size {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-timeout:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// process 占用一个 worker 调用 fn, 成功后 mark msgs 的 offset
+// ctx 取消导致的失败不 mark 也不返回 error
+func (c *KafComsumer) process(ctx context.Context, comsumer ClusterConsumer, msgs []*sarama.ConsumerMessage, fn func([]*sarama.ConsumerMessage) error) error {
+	if c.limiter != nil && !c.limiter.wait(ctx, len(msgs)) {
+		return nil
+	}
+	if c.sem != nil {
+		select {
+		case <-ctx.Done():
+			return nil
+		case c.sem <- struct{}{}:
+		}
+	}
+	err := c.handle(ctx, msgs, func() error {
+		if c.Dedup != nil {
+			return c.dedup(msgs, fn)
+		}
+		return fn(msgs)
+	})
+	if c.sem != nil {
+		<-c.sem
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	for _, msg := range msgs {
+		comsumer.MarkOffset(msg, "") //MarkOffset 并不是实时写入kafka，有可能在程序crash时丢掉未提交的offset, 需要时开启 SyncCommit
+		c.marked(msg)
+		c.metrics().Consumed(msg.Topic, msg.Partition, 1)
+	}
+	if c.SyncCommit {
+		if err := comsumer.CommitOffsets(); err != nil {
+			// 提交失败的 offset 仍是 dirty 状态, 下次提交时会带上
+			c.reportError(err)
+		}
+	}
+	return nil
+}
+
+// dedup 过滤 Dedup 已处理过的消息, 其余交给 fn, 成功后记录
+func (c *KafComsumer) dedup(msgs []*sarama.ConsumerMessage, fn func([]*sarama.ConsumerMessage) error) error {
+	pending := make([]*sarama.ConsumerMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		seen, err := c.Dedup.Seen(msg)
+		if err != nil {
+			return err
+		}
+		if !seen {
+			pending = append(pending, msg)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := fn(pending); err != nil {
+		return err
+	}
+	for _, msg := range pending {
+		if err := c.Dedup.Done(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handle 按 OnFailure 调用 fn, 返回 nil 时可以 mark offset
+func (c *KafComsumer) handle(ctx context.Context, msgs []*sarama.ConsumerMessage, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := c.call(msgs[0], fn)
+		c.metrics().Latency(msgs[0].Topic, time.Since(start))
+		if err == nil {
 			return nil
-		case <-comsumer.Notifications():
-		case msg := <-comsumer.Messages():
-			if c.Process != nil {
-				c.Process.Process(msg.Value)
+		}
+		c.metrics().Error(msgs[0].Topic, ErrorProcess)
+
+		perr := &ProcessError{
+			Topic:     msgs[0].Topic,
+			Partition: msgs[0].Partition,
+			Offset:    msgs[0].Offset,
+			Attempts:  attempt,
+			Err:       err,
+		}
+		if len(msgs) > 1 {
+			perr.Batch = len(msgs)
+		}
+		switch c.OnFailure {
+		case FailSkip:
+			fmt.Printf("[ERROR] skip %s\n", perr.Error())
+			return nil
+		case FailStop:
+			return perr
+		case FailDeadLetter:
+			if attempt > c.Retries {
+				return c.deadLetter(msgs, perr)
+			}
+		default:
+			if c.Retries > 0 && attempt > c.Retries {
+				return perr
+			}
+		}
+
+		fmt.Printf("[WARN] retry %s\n", perr.Error())
+		backoff := c.RetryBackoff
+		if backoff <= 0 {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// call 调用 fn 并把 panic 转为 *PanicError, 批量处理时 msg 为该批第一条消息
+func (c *KafComsumer) call(msg *sarama.ConsumerMessage, fn func() error) error {
+	return protect(msg, fn, func(err *PanicError) {
+		if c.OnPanic != nil {
+			c.OnPanic(err)
+		} else {
+			fmt.Printf("[ERROR] %s\n", err.Error())
+		}
+	})
+}
+
+// deadLetter 把原消息连同失败信息写入死信 topic, 写入失败时返回 error 停止消费
+func (c *KafComsumer) deadLetter(msgs []*sarama.ConsumerMessage, perr *ProcessError) error {
+	for _, msg := range msgs {
+		headers := make(map[string]string, len(msg.Headers)+5)
+		for _, h := range msg.Headers {
+			if h != nil {
+				headers[string(h.Key)] = string(h.Value)
 			}
-			comsumer.MarkOffset(msg, "") //MarkOffset 并不是实时写入kafka，有可能在程序crash时丢掉未提交的offset
 		}
+		headers[HeaderOriginalTopic] = msg.Topic
+		headers[HeaderOriginalPartition] = strconv.FormatInt(int64(msg.Partition), 10)
+		headers[HeaderOriginalOffset] = strconv.FormatInt(msg.Offset, 10)
+		headers[HeaderError] = perr.Err.Error()
+		headers[HeaderAttempts] = strconv.Itoa(perr.Attempts)
+
+		_, _, err := c.dlq.Publish(&Message{
+			Topic:   c.DeadLetterTopic,
+			Key:     msg.Key,
+			Value:   msg.Value,
+			Headers: headers,
+		})
+		if err != nil {
+			return fmt.Errorf("kafka dead letter topic:%s error:%v, %s", c.DeadLetterTopic, err, perr.Error())
+		}
+		c.metrics().Error(msg.Topic, ErrorDeadLetter)
 	}
+	fmt.Printf("[ERROR] dead letter %s\n", perr.Error())
 	return nil
 }
@@ -1,10 +1,14 @@
-package kafka
+package kafka_test
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/wthsjy/hswjywtgu2/kafka"
+	"github.com/wthsjy/hswjywtgu2/kafka/kafkatest"
 )
 
 type C struct {
@@ -14,18 +18,27 @@ func (c *C) Process(bs []byte) {
 	fmt.Println(string(bs[:]))
 }
 func TestKafComsumer_Comsumer(t *testing.T) {
-	comsumer := KafComsumer{
+	b := kafkatest.NewBroker(1)
+	b.Produce("topic_test", nil, []byte("hello"), nil)
+
+	comsumer := kafka.KafComsumer{
 		Addr:    strings.Split("127.0.0.1:9092", ","),
 		Topics:  strings.Split("topic_test", ","),
 		GroupId: "group_id",
 		Process: &C{},
+		Dial:    b.Dial,
 	}
-	for {
-		err := comsumer.Comsumer()
-		if err != nil {
-			fmt.Printf("error:%s\n", err.Error())
-		}
-		time.Sleep(time.Second)
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- comsumer.Run(ctx)
+	}()
 
+	if !b.WaitCommitted("group_id", "topic_test", 0, 1, 5*time.Second) {
+		t.Error("offset not committed")
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("error:%s\n", err.Error())
+	}
 }
@@ -0,0 +1,58 @@
+package kafka
+
+import (
+	"io"
+	"net"
+
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+)
+
+// transientErrors broker 会自行恢复的错误, 出现时不需要断开消费者
+var transientErrors = []error{
+	sarama.ErrOutOfBrokers,
+	sarama.ErrNotConnected,
+	sarama.ErrUnknownTopicOrPartition,
+	sarama.ErrLeaderNotAvailable,
+	sarama.ErrNotLeaderForPartition,
+	sarama.ErrRequestTimedOut,
+	sarama.ErrBrokerNotAvailable,
+	sarama.ErrReplicaNotAvailable,
+	sarama.ErrNetworkException,
+	sarama.ErrOffsetsLoadInProgress,
+	sarama.ErrConsumerCoordinatorNotAvailable,
+	sarama.ErrNotCoordinatorForConsumer,
+	sarama.ErrNotEnoughReplicas,
+	sarama.ErrNotEnoughReplicasAfterAppend,
+	sarama.ErrIllegalGeneration,
+	sarama.ErrUnknownMemberId,
+	sarama.ErrRebalanceInProgress,
+	io.EOF,
+}
+
+// IsTransient 判断 kafka 错误是否为临时错误
+func IsTransient(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *sarama.ConsumerError:
+		return IsTransient(e.Err)
+	case *cluster.Error:
+		// cluster.Error 无法取出原始 error, 只能按错误信息比较
+		for _, t := range transientErrors {
+			if e.Error() == t.Error() {
+				return true
+			}
+		}
+		return false
+	case net.Error:
+		return true
+	}
+
+	for _, t := range transientErrors {
+		if err == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPauseNoWorkers 没有设置 Workers 时所有分区共用一个消息通道, 无法只暂停单个分区
+var ErrPauseNoWorkers = errors.New("kafka Pause requires Workers > 0")
+
+// limiter 按固定间隔放行消息, 不允许突发
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(rate float64) *limiter {
+	return &limiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait 等待放行 n 条消息, ctx 取消时返回 false
+func (l *limiter) wait(ctx context.Context, n int) bool {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = at.Add(time.Duration(n) * l.interval)
+	l.mu.Unlock()
+
+	if d := at.Sub(now); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+		}
+	}
+	return true
+}
+
+type pauseState struct {
+	resume   chan struct{}
+	released bool
+}
+
+// Pause 暂停处理分区的消息, 可以在 Handler 中调用以表示下游过载
+// 只阻塞该分区, sarama 缓冲写满后停止拉取该分区, 其他分区照常消费;
+// 需要 Workers 模式(按分区消费), 否则返回 ErrPauseNoWorkers
+// 暂停期间消费组心跳照常进行, 不会触发 rebalance
+func (c *KafComsumer) Pause(topic string, partition int32) error {
+	if c.Workers <= 0 {
+		return ErrPauseNoWorkers
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.paused == nil {
+		c.paused = make(map[string]map[int32]*pauseState)
+	}
+	if c.paused[topic] == nil {
+		c.paused[topic] = make(map[int32]*pauseState)
+	}
+	if _, ok := c.paused[topic][partition]; !ok {
+		c.paused[topic][partition] = &pauseState{resume: make(chan struct{})}
+	}
+	return nil
+}
+
+// Resume 恢复 Pause 暂停的分区
+func (c *KafComsumer) Resume(topic string, partition int32) {
+	c.unpause(topic, partition, false)
+}
+
+// Paused 返回分区是否处于暂停状态
+func (c *KafComsumer) Paused(topic string, partition int32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.paused[topic][partition]
+	return ok
+}
+
+func (c *KafComsumer) unpause(topic string, partition int32, released bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if st, ok := c.paused[topic][partition]; ok {
+		st.released = released
+		close(st.resume)
+		delete(c.paused[topic], partition)
+	}
+}
+
+// waitResume 分区暂停时等待恢复, 返回 false 表示 ctx 已取消或分区已被回收, 消息不应再处理
+func (c *KafComsumer) waitResume(ctx context.Context, topic string, partition int32) bool {
+	c.mu.Lock()
+	st, ok := c.paused[topic][partition]
+	c.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-st.resume:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !st.released
+}
@@ -0,0 +1,236 @@
+// Package kafkatest 内存中的 kafka, 用于在没有 broker 的环境下测试 kafka.KafComsumer 和 kafka.KafProducer
+//
+//	b := kafkatest.NewBroker(2)
+//	b.Produce("topic", nil, []byte("hello"), nil)
+//	c := kafka.KafComsumer{Topics: []string{"topic"}, GroupId: "group", Handler: h, Dial: b.Dial}
+//	p := kafka.KafProducer{DialSync: b.SyncProducer, DialAsync: b.AsyncProducer}
+package kafkatest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+	"github.com/wthsjy/hswjywtgu2/kafka"
+)
+
+// Broker 按 topic/partition 保存消息和消费组已提交的 offset, 并发安全
+// 同一消费组的每个消费者都会分配到全部分区, 不模拟多实例 rebalance, 可以用 Release 模拟分区被回收
+type Broker struct {
+	partitions int
+
+	mu        sync.Mutex
+	topics    map[string][][]*sarama.ConsumerMessage
+	committed map[string]map[string]map[int32]int64 // group -> topic -> partition -> 下一条要消费的 offset
+	consumers map[*consumer]struct{}
+	changed   chan struct{} // 有新消息或新提交时关闭并替换
+}
+
+// NewBroker partitions 为自动创建 topic 的分区数, 小于 1 时为 1
+func NewBroker(partitions int) *Broker {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &Broker{
+		partitions: partitions,
+		topics:     make(map[string][][]*sarama.ConsumerMessage),
+		committed:  make(map[string]map[string]map[int32]int64),
+		consumers:  make(map[*consumer]struct{}),
+		changed:    make(chan struct{}),
+	}
+}
+
+// Produce 直接写入一条消息, 返回写入的分区和 offset, 分区按 key 哈希选择
+func (b *Broker) Produce(topic string, key, value []byte, headers map[string]string) (int32, int64) {
+	msg := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(value)}
+	if key != nil {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+	for k, v := range headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+
+	partition, err := sarama.NewHashPartitioner(topic).Partition(msg, int32(b.partitions))
+	if err != nil {
+		partition = 0
+	}
+	msg.Partition = partition
+	b.append(msg)
+	return msg.Partition, msg.Offset
+}
+
+// Messages 返回 topic 所有分区的消息, 同一分区内按 offset 排序
+func (b *Broker) Messages(topic string) []*sarama.ConsumerMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var msgs []*sarama.ConsumerMessage
+	for _, partition := range b.topics[topic] {
+		msgs = append(msgs, partition...)
+	}
+	return msgs
+}
+
+// Committed 返回消费组在分区上已提交的 offset(下一条要消费的消息), 未提交时返回 -1
+func (b *Broker) Committed(group, topic string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if offset, ok := b.committed[group][topic][partition]; ok {
+		return offset
+	}
+	return -1
+}
+
+// WaitCommitted 等待消费组在分区上提交的 offset 不小于 offset, 超时返回 false
+func (b *Broker) WaitCommitted(group, topic string, partition int32, offset int64, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		b.mu.Lock()
+		committed, ok := b.committed[group][topic][partition]
+		changed := b.changed
+		b.mu.Unlock()
+
+		if ok && committed >= offset {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Fail 向所有未关闭的消费者的 Errors() 发送 err, 需要开启 Consumer.Return.Errors
+func (b *Broker) Fail(err error) {
+	b.mu.Lock()
+	consumers := make([]*consumer, 0, len(b.consumers))
+	for c := range b.consumers {
+		consumers = append(consumers, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range consumers {
+		c.fail(err)
+	}
+}
+
+// Release 模拟 rebalance 回收所有消费者的分区: 停止投递该分区的消息, 发送 RebalanceStart 和 RebalanceOK 通知
+func (b *Broker) Release(topic string, partition int32) {
+	b.mu.Lock()
+	consumers := make([]*consumer, 0, len(b.consumers))
+	for c := range b.consumers {
+		consumers = append(consumers, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range consumers {
+		c.release(topic, partition)
+	}
+}
+
+// Dial 可以直接赋值给 kafka.KafComsumer.Dial
+func (b *Broker) Dial(addr []string, groupId string, topics []string, conf *cluster.Config) (kafka.ClusterConsumer, error) {
+	if conf == nil {
+		conf = cluster.NewConfig()
+	}
+	return newConsumer(b, groupId, topics, conf), nil
+}
+
+// SyncProducer 可以直接赋值给 kafka.KafProducer.DialSync
+func (b *Broker) SyncProducer(conf *sarama.Config) (sarama.SyncProducer, error) {
+	if conf == nil {
+		conf = sarama.NewConfig()
+	}
+	return &syncProducer{b: b, conf: conf}, nil
+}
+
+// AsyncProducer 可以直接赋值给 kafka.KafProducer.DialAsync
+func (b *Broker) AsyncProducer(conf *sarama.Config) (sarama.AsyncProducer, error) {
+	if conf == nil {
+		conf = sarama.NewConfig()
+	}
+	return newAsyncProducer(b, conf), nil
+}
+
+// partitionsOf 返回 topic 的分区, 不存在时自动创建, 调用方需持有 b.mu
+func (b *Broker) partitionsOf(topic string) [][]*sarama.ConsumerMessage {
+	partitions, ok := b.topics[topic]
+	if !ok {
+		partitions = make([][]*sarama.ConsumerMessage, b.partitions)
+		b.topics[topic] = partitions
+	}
+	return partitions
+}
+
+// append 写入 msg.Partition 分区并回填 msg.Offset
+func (b *Broker) append(msg *sarama.ProducerMessage) {
+	cm := &sarama.ConsumerMessage{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Timestamp: time.Now(),
+	}
+	if msg.Key != nil {
+		cm.Key, _ = msg.Key.Encode()
+	}
+	if msg.Value != nil {
+		cm.Value, _ = msg.Value.Encode()
+	}
+	for i := range msg.Headers {
+		h := msg.Headers[i]
+		cm.Headers = append(cm.Headers, &h)
+	}
+
+	b.mu.Lock()
+	partitions := b.partitionsOf(msg.Topic)
+	cm.Offset = int64(len(partitions[msg.Partition]))
+	partitions[msg.Partition] = append(partitions[msg.Partition], cm)
+	msg.Offset = cm.Offset
+	b.broadcast()
+	b.mu.Unlock()
+}
+
+// fetch 等待并返回分区上 offset 处的消息, dying 关闭时返回 nil
+func (b *Broker) fetch(topic string, partition int32, offset int64, dying <-chan struct{}) *sarama.ConsumerMessage {
+	for {
+		b.mu.Lock()
+		msgs := b.partitionsOf(topic)[partition]
+		changed := b.changed
+		b.mu.Unlock()
+
+		if offset < int64(len(msgs)) {
+			return msgs[offset]
+		}
+		select {
+		case <-changed:
+		case <-dying:
+			return nil
+		}
+	}
+}
+
+func (b *Broker) commit(group string, offsets map[string]map[int32]int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.committed[group] == nil {
+		b.committed[group] = make(map[string]map[int32]int64)
+	}
+	for topic, partitions := range offsets {
+		if b.committed[group][topic] == nil {
+			b.committed[group][topic] = make(map[int32]int64)
+		}
+		for partition, offset := range partitions {
+			b.committed[group][topic][partition] = offset
+		}
+	}
+	b.broadcast()
+}
+
+// broadcast 唤醒 fetch 和 WaitCommitted, 调用方需持有 b.mu
+func (b *Broker) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
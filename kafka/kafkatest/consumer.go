@@ -0,0 +1,361 @@
+package kafkatest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+)
+
+// consumer 实现 kafka.ClusterConsumer, 支持 multiplex 和 partitions 两种模式,
+// 与 sarama-cluster 一样按 Consumer.Offsets.CommitInterval 自动提交 mark 过的 offset
+type consumer struct {
+	b      *Broker
+	group  string
+	topics []string
+	conf   *cluster.Config
+
+	messages      chan *sarama.ConsumerMessage
+	partitions    chan cluster.PartitionConsumer
+	errors        chan error
+	notifications chan *cluster.Notification
+
+	mu     sync.Mutex
+	marked map[string]map[int32]int64 // 下一条要消费的 offset, 与 kafka 提交的语义一致
+	dirty  bool
+	owned  map[string]map[int32]func() // 持有的分区及停止投递的函数
+
+	notifyMu  sync.Mutex // 保护 Close 后不再写入 notifications
+	dying     chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func newConsumer(b *Broker, group string, topics []string, conf *cluster.Config) *consumer {
+	c := &consumer{
+		b:             b,
+		group:         group,
+		topics:        topics,
+		conf:          conf,
+		messages:      make(chan *sarama.ConsumerMessage, conf.ChannelBufferSize),
+		partitions:    make(chan cluster.PartitionConsumer, 1),
+		errors:        make(chan error, conf.ChannelBufferSize),
+		notifications: make(chan *cluster.Notification, 2),
+		marked:        make(map[string]map[int32]int64),
+		owned:         make(map[string]map[int32]func()),
+		dying:         make(chan struct{}),
+	}
+
+	claimed := make(map[string][]int32)
+	offsets := make(map[string]map[int32]int64)
+	b.mu.Lock()
+	for _, topic := range topics {
+		partitions := b.partitionsOf(topic)
+		offsets[topic] = make(map[int32]int64)
+		for p := range partitions {
+			claimed[topic] = append(claimed[topic], int32(p))
+			offset, ok := b.committed[group][topic][int32(p)]
+			if !ok {
+				offset = 0
+				if conf.Consumer.Offsets.Initial == sarama.OffsetNewest {
+					offset = int64(len(partitions[p]))
+				}
+			}
+			offsets[topic][int32(p)] = offset
+		}
+	}
+	b.consumers[c] = struct{}{}
+	b.mu.Unlock()
+
+	if conf.Group.Return.Notifications {
+		c.notifications <- &cluster.Notification{Type: cluster.RebalanceStart, Current: map[string][]int32{}}
+		c.notifications <- &cluster.Notification{
+			Type:     cluster.RebalanceOK,
+			Claimed:  claimed,
+			Released: map[string][]int32{},
+			Current:  claimed,
+		}
+	}
+
+	if interval := conf.Consumer.Offsets.CommitInterval; interval > 0 {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					c.CommitOffsets()
+				case <-c.dying:
+					return
+				}
+			}
+		}()
+	}
+
+	var pcs []*partitionConsumer
+	for topic, partitions := range offsets {
+		c.owned[topic] = make(map[int32]func())
+		for partition, offset := range partitions {
+			if conf.Group.Mode == cluster.ConsumerModePartitions {
+				pc := newPartitionConsumer(c, topic, partition, offset)
+				c.owned[topic][partition] = pc.AsyncClose
+				pcs = append(pcs, pc)
+				continue
+			}
+
+			stop := make(chan struct{})
+			c.owned[topic][partition] = func() { close(stop) }
+			c.wg.Add(1)
+			go func(topic string, partition int32, offset int64) {
+				defer c.wg.Done()
+				c.feed(topic, partition, offset, c.messages, either(stop, c.dying))
+			}(topic, partition, offset)
+		}
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for _, pc := range pcs {
+			select {
+			case c.partitions <- pc:
+			case <-c.dying:
+				pc.Close()
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// either 返回 a 或 b 关闭后随之关闭的 channel
+func either(a, b <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-a:
+		case <-b:
+		}
+		close(done)
+	}()
+	return done
+}
+
+// release 停止投递分区的消息并发送 rebalance 通知, 不持有该分区时忽略
+func (c *consumer) release(topic string, partition int32) {
+	c.mu.Lock()
+	stop, ok := c.owned[topic][partition]
+	delete(c.owned[topic], partition)
+	current := make(map[string][]int32)
+	for t, partitions := range c.owned {
+		for p := range partitions {
+			current[t] = append(current[t], p)
+		}
+	}
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	stop()
+
+	if !c.conf.Group.Return.Notifications {
+		return
+	}
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	for _, n := range []*cluster.Notification{
+		{Type: cluster.RebalanceStart, Current: current},
+		{
+			Type:     cluster.RebalanceOK,
+			Claimed:  map[string][]int32{},
+			Released: map[string][]int32{topic: {partition}},
+			Current:  current,
+		},
+	} {
+		select {
+		case c.notifications <- n:
+		case <-c.dying:
+			return
+		}
+	}
+}
+
+// feed 从 offset 开始把分区消息写入 out, 直到 dying 关闭
+func (c *consumer) feed(topic string, partition int32, offset int64, out chan<- *sarama.ConsumerMessage, dying <-chan struct{}) {
+	for {
+		msg := c.b.fetch(topic, partition, offset, dying)
+		if msg == nil {
+			return
+		}
+		select {
+		case out <- msg:
+			offset++
+		case <-dying:
+			return
+		}
+	}
+}
+
+func (c *consumer) fail(err error) {
+	if !c.conf.Consumer.Return.Errors {
+		return
+	}
+	select {
+	case c.errors <- err:
+	case <-c.dying:
+	}
+}
+
+func (c *consumer) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func (c *consumer) Partitions() <-chan cluster.PartitionConsumer { return c.partitions }
+
+func (c *consumer) Errors() <-chan error { return c.errors }
+
+func (c *consumer) Notifications() <-chan *cluster.Notification { return c.notifications }
+
+func (c *consumer) MarkOffset(msg *sarama.ConsumerMessage, metadata string) {
+	c.markPartition(msg.Topic, msg.Partition, msg.Offset+1)
+}
+
+func (c *consumer) markPartition(topic string, partition int32, offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.marked[topic] == nil {
+		c.marked[topic] = make(map[int32]int64)
+	}
+	if offset > c.marked[topic][partition] {
+		c.marked[topic][partition] = offset
+		c.dirty = true
+	}
+}
+
+func (c *consumer) HighWaterMarks() map[string]map[int32]int64 {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	hwms := make(map[string]map[int32]int64)
+	for _, topic := range c.topics {
+		hwms[topic] = make(map[int32]int64)
+		for p, msgs := range c.b.partitionsOf(topic) {
+			hwms[topic][int32(p)] = int64(len(msgs))
+		}
+	}
+	return hwms
+}
+
+func (c *consumer) CommitOffsets() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	c.b.commit(c.group, c.marked)
+	c.dirty = false
+	return nil
+}
+
+func (c *consumer) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.dying)
+		c.wg.Wait()
+		c.CommitOffsets()
+		close(c.messages)
+		close(c.partitions)
+		c.notifyMu.Lock()
+		close(c.notifications)
+		c.notifyMu.Unlock()
+
+		c.b.mu.Lock()
+		delete(c.b.consumers, c)
+		c.b.mu.Unlock()
+	})
+	return nil
+}
+
+// partitionConsumer 实现 cluster.PartitionConsumer
+type partitionConsumer struct {
+	c             *consumer
+	topic         string
+	partition     int32
+	initialOffset int64
+
+	messages  chan *sarama.ConsumerMessage
+	errors    chan *sarama.ConsumerError
+	dying     chan struct{}
+	dead      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPartitionConsumer(c *consumer, topic string, partition int32, offset int64) *partitionConsumer {
+	pc := &partitionConsumer{
+		c:             c,
+		topic:         topic,
+		partition:     partition,
+		initialOffset: offset,
+		messages:      make(chan *sarama.ConsumerMessage, c.conf.ChannelBufferSize),
+		errors:        make(chan *sarama.ConsumerError, c.conf.ChannelBufferSize),
+		dying:         make(chan struct{}),
+		dead:          make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(pc.dead)
+		defer close(pc.errors)
+		defer close(pc.messages)
+
+		c.feed(topic, partition, offset, pc.messages, either(pc.dying, c.dying))
+	}()
+	return pc
+}
+
+func (pc *partitionConsumer) AsyncClose() {
+	pc.closeOnce.Do(func() { close(pc.dying) })
+}
+
+func (pc *partitionConsumer) Close() error {
+	pc.AsyncClose()
+	<-pc.dead
+	return nil
+}
+
+func (pc *partitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+
+func (pc *partitionConsumer) Errors() <-chan *sarama.ConsumerError { return pc.errors }
+
+func (pc *partitionConsumer) HighWaterMarkOffset() int64 {
+	pc.c.b.mu.Lock()
+	defer pc.c.b.mu.Unlock()
+	return int64(len(pc.c.b.partitionsOf(pc.topic)[pc.partition]))
+}
+
+func (pc *partitionConsumer) Topic() string { return pc.topic }
+
+func (pc *partitionConsumer) Partition() int32 { return pc.partition }
+
+func (pc *partitionConsumer) InitialOffset() int64 { return pc.initialOffset }
+
+// MarkOffset 与 sarama-cluster 一致, offset 为已处理消息的 offset
+func (pc *partitionConsumer) MarkOffset(offset int64, metadata string) {
+	pc.c.markPartition(pc.topic, pc.partition, offset+1)
+}
+
+func (pc *partitionConsumer) ResetOffset(offset int64, metadata string) {
+	pc.c.mu.Lock()
+	defer pc.c.mu.Unlock()
+
+	if pc.c.marked[pc.topic] == nil {
+		pc.c.marked[pc.topic] = make(map[int32]int64)
+	}
+	if next := offset + 1; next <= pc.c.marked[pc.topic][pc.partition] {
+		pc.c.marked[pc.topic][pc.partition] = next
+		pc.c.dirty = true
+	}
+}
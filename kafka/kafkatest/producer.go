@@ -0,0 +1,118 @@
+package kafkatest
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// partition 按 conf 中的 partitioner 为 msg 选择分区
+func (b *Broker) partition(conf *sarama.Config, msg *sarama.ProducerMessage) error {
+	b.mu.Lock()
+	n := int32(len(b.partitionsOf(msg.Topic)))
+	b.mu.Unlock()
+
+	newPartitioner := conf.Producer.Partitioner
+	if newPartitioner == nil {
+		newPartitioner = sarama.NewHashPartitioner
+	}
+	partition, err := newPartitioner(msg.Topic).Partition(msg, n)
+	if err != nil {
+		return err
+	}
+	if partition < 0 || partition >= n {
+		return sarama.ErrInvalidPartition
+	}
+	msg.Partition = partition
+	return nil
+}
+
+// syncProducer 实现 sarama.SyncProducer, 消息直接写入 Broker
+type syncProducer struct {
+	b    *Broker
+	conf *sarama.Config
+}
+
+func (p *syncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if err := p.b.partition(p.conf, msg); err != nil {
+		return -1, -1, err
+	}
+	p.b.append(msg)
+	return msg.Partition, msg.Offset, nil
+}
+
+func (p *syncProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	var errs sarama.ProducerErrors
+	for _, msg := range msgs {
+		if _, _, err := p.SendMessage(msg); err != nil {
+			errs = append(errs, &sarama.ProducerError{Msg: msg, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *syncProducer) Close() error {
+	return nil
+}
+
+// asyncProducer 实现 sarama.AsyncProducer, 按 conf.Producer.Return 返回结果
+type asyncProducer struct {
+	b         *Broker
+	conf      *sarama.Config
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	closeOnce sync.Once
+	dead      chan struct{}
+}
+
+func newAsyncProducer(b *Broker, conf *sarama.Config) *asyncProducer {
+	p := &asyncProducer{
+		b:         b,
+		conf:      conf,
+		input:     make(chan *sarama.ProducerMessage, conf.ChannelBufferSize),
+		successes: make(chan *sarama.ProducerMessage, conf.ChannelBufferSize),
+		errors:    make(chan *sarama.ProducerError, conf.ChannelBufferSize),
+		dead:      make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *asyncProducer) loop() {
+	defer close(p.dead)
+	defer close(p.errors)
+	defer close(p.successes)
+
+	for msg := range p.input {
+		if err := p.b.partition(p.conf, msg); err != nil {
+			if p.conf.Producer.Return.Errors {
+				p.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			}
+			continue
+		}
+		p.b.append(msg)
+		if p.conf.Producer.Return.Successes {
+			p.successes <- msg
+		}
+	}
+}
+
+func (p *asyncProducer) AsyncClose() {
+	p.closeOnce.Do(func() { close(p.input) })
+}
+
+func (p *asyncProducer) Close() error {
+	p.AsyncClose()
+	<-p.dead
+	return nil
+}
+
+func (p *asyncProducer) Input() chan<- *sarama.ProducerMessage { return p.input }
+
+func (p *asyncProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+
+func (p *asyncProducer) Errors() <-chan *sarama.ProducerError { return p.errors }
@@ -0,0 +1,813 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/bsm/sarama-cluster"
+	"github.com/wthsjy/hswjywtgu2/kafka"
+	"github.com/wthsjy/hswjywtgu2/kafka/kafkatest"
+)
+
+// countHandler 处理 n 条消息后取消 ctx, fail 返回 true 的消息处理失败
+type countHandler struct {
+	mu     sync.Mutex
+	n      int
+	cancel context.CancelFunc
+	fail   func(msg *sarama.ConsumerMessage) bool
+	values []string
+}
+
+func (h *countHandler) Handle(msg *sarama.ConsumerMessage) error {
+	if h.fail != nil && h.fail(msg) {
+		return errors.New("bad message")
+	}
+	h.done(msg)
+	return nil
+}
+
+func (h *countHandler) HandleBatch(msgs []*sarama.ConsumerMessage) error {
+	for _, msg := range msgs {
+		h.done(msg)
+	}
+	return nil
+}
+
+func (h *countHandler) done(msg *sarama.ConsumerMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.values = append(h.values, string(msg.Value))
+	if len(h.values) == h.n {
+		h.cancel()
+	}
+}
+
+func runConsumer(ctx context.Context, t *testing.T, c *kafka.KafComsumer, cancel context.CancelFunc) {
+	defer cancel()
+	if err := c.Run(ctx); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+}
+
+func TestKafComsumer_RunHandler(t *testing.T) {
+	b := kafkatest.NewBroker(2)
+	for _, v := range []string{"a", "b", "c", "d", "e", "f"} {
+		b.Produce("topic_test", []byte(v), []byte(v), nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	h := &countHandler{n: 6, cancel: cancel}
+	c := &kafka.KafComsumer{
+		Topics:  []string{"topic_test"},
+		GroupId: "group_id",
+		Handler: h,
+		Dial:    b.Dial,
+	}
+	runConsumer(ctx, t, c, cancel)
+
+	if len(h.values) != 6 {
+		t.Fatalf("handled %d messages, want 6", len(h.values))
+	}
+	var committed int64
+	for p := int32(0); p < 2; p++ {
+		committed += b.Committed("group_id", "topic_test", p)
+	}
+	if committed != 6 {
+		t.Fatalf("committed %d, want 6", committed)
+	}
+}
+
+func TestKafComsumer_DeadLetter(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	b.Produce("topic_test", nil, []byte("bad"), nil)
+	b.Produce("topic_test", nil, []byte("good"), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	h := &countHandler{n: 1, cancel: cancel, fail: func(msg *sarama.ConsumerMessage) bool {
+		return string(msg.Value) == "bad"
+	}}
+	c := &kafka.KafComsumer{
+		Topics:          []string{"topic_test"},
+		GroupId:         "group_id",
+		Handler:         h,
+		OnFailure:       kafka.FailDeadLetter,
+		Retries:         1,
+		RetryBackoff:    time.Millisecond,
+		DeadLetterTopic: "topic_dlq",
+		DeadLetter:      &kafka.KafProducer{DialSync: b.SyncProducer, DialAsync: b.AsyncProducer},
+		Dial:            b.Dial,
+	}
+	runConsumer(ctx, t, c, cancel)
+
+	if got := b.Committed("group_id", "topic_test", 0); got != 2 {
+		t.Fatalf("committed %d, want 2", got)
+	}
+	dlq := b.Messages("topic_dlq")
+	if len(dlq) != 1 || string(dlq[0].Value) != "bad" {
+		t.Fatalf("dead letter messages %v", dlq)
+	}
+	headers := make(map[string]string)
+	for _, h := range dlq[0].Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	if headers[kafka.HeaderOriginalTopic] != "topic_test" || headers[kafka.HeaderOriginalOffset] != "0" || headers[kafka.HeaderAttempts] != "2" {
+		t.Fatalf("dead letter headers %v", headers)
+	}
+}
+
+func TestKafComsumer_FailStop(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	b.Produce("topic_test", nil, []byte("bad"), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &kafka.KafComsumer{
+		Topics:    []string{"topic_test"},
+		GroupId:   "group_id",
+		Handler:   &countHandler{fail: func(*sarama.ConsumerMessage) bool { return true }},
+		OnFailure: kafka.FailStop,
+		Dial:      b.Dial,
+	}
+	err := c.Run(ctx)
+	if _, ok := err.(*kafka.ProcessError); !ok {
+		t.Fatalf("run error %v, want *ProcessError", err)
+	}
+	if got := b.Committed("group_id", "topic_test", 0); got != -1 {
+		t.Fatalf("committed %d, want none", got)
+	}
+}
+
+func TestKafComsumer_BatchWorkers(t *testing.T) {
+	b := kafkatest.NewBroker(3)
+	for i := 0; i < 20; i++ {
+		b.Produce("topic_test", []byte{byte(i)}, []byte{byte(i)}, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	h := &countHandler{n: 20, cancel: cancel}
+	c := &kafka.KafComsumer{
+		Topics:       []string{"topic_test"},
+		GroupId:      "group_id",
+		BatchHandler: h,
+		BatchSize:    4,
+		BatchWait:    10 * time.Millisecond,
+		Workers:      2,
+		Dial:         b.Dial,
+	}
+	runConsumer(ctx, t, c, cancel)
+
+	if len(h.values) != 20 {
+		t.Fatalf("handled %d messages, want 20", len(h.values))
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{sarama.ErrNotLeaderForPartition, true},
+		{&sarama.ConsumerError{Topic: "topic_test", Err: sarama.ErrRebalanceInProgress}, true},
+		{io.EOF, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{sarama.ErrInvalidMessage, false},
+		{&sarama.ConsumerError{Topic: "topic_test", Err: sarama.ErrTopicAuthorizationFailed}, false},
+		{errors.New("fatal"), false},
+	}
+	for _, c := range cases {
+		if got := kafka.IsTransient(c.err); got != c.want {
+			t.Errorf("IsTransient(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+// brokerError OnError 收到的错误
+type brokerError struct {
+	err       error
+	transient bool
+}
+
+func TestKafComsumer_Reconnect(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	b.Produce("topic_test", nil, []byte("a"), nil)
+
+	var mu sync.Mutex
+	dials := 0
+	handled := make(chan struct{}, 1)
+	errs := make(chan brokerError, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &kafka.KafComsumer{
+		Topics:  []string{"topic_test"},
+		GroupId: "group_id",
+		Handler: kafka.HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			handled <- struct{}{}
+			return nil
+		}),
+		OnError:          func(err error, transient bool) { errs <- brokerError{err, transient} },
+		ReconnectBackoff: time.Millisecond,
+		Dial: func(addr []string, groupId string, topics []string, conf *cluster.Config) (kafka.ClusterConsumer, error) {
+			mu.Lock()
+			dials++
+			mu.Unlock()
+			return b.Dial(addr, groupId, topics, conf)
+		},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+	<-handled
+
+	// 临时错误只上报, 不断开
+	b.Fail(sarama.ErrNotLeaderForPartition)
+	if e := <-errs; e.err != sarama.ErrNotLeaderForPartition || !e.transient {
+		t.Fatalf("on error %v transient:%v", e.err, e.transient)
+	}
+	b.Produce("topic_test", nil, []byte("b"), nil)
+	<-handled
+	mu.Lock()
+	if dials != 1 {
+		t.Fatalf("dials %d after transient error, want 1", dials)
+	}
+	mu.Unlock()
+
+	// 其他错误断开后重连, 从已提交的 offset 继续消费
+	b.Fail(errors.New("fatal"))
+	if e := <-errs; e.transient {
+		t.Fatalf("on error %v transient:%v", e.err, e.transient)
+	}
+	for deadline := time.Now().Add(3 * time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := dials
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dials %d after fatal error, want 2", n)
+		}
+	}
+	b.Produce("topic_test", nil, []byte("c"), nil)
+	<-handled
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Committed("group_id", "topic_test", 0); got != 3 {
+		t.Fatalf("committed %d, want 3", got)
+	}
+}
+
+func TestKafComsumer_Rebalance(t *testing.T) {
+	b := kafkatest.NewBroker(2)
+
+	var mu sync.Mutex
+	var types []cluster.NotificationType
+	claimed := make(chan map[string][]int32, 1)
+	released := make(chan map[string][]int32, 1)
+	inflight := make(chan struct{})
+	unblock := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &kafka.KafComsumer{
+		Topics:  []string{"topic_test"},
+		GroupId: "group_id",
+		Handler: kafka.HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			close(inflight)
+			<-unblock
+			return nil
+		}),
+		Workers: 2,
+		OnRebalance: func(n *cluster.Notification) {
+			mu.Lock()
+			types = append(types, n.Type)
+			mu.Unlock()
+		},
+		OnClaimed:  func(c, current map[string][]int32) { claimed <- c },
+		OnReleased: func(r map[string][]int32) { released <- r },
+		Dial:       b.Dial,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	if got := <-claimed; len(got["topic_test"]) != 2 {
+		t.Fatalf("claimed %v", got)
+	}
+	for i := 0; ; i++ {
+		if p, _ := b.Produce("topic_test", []byte{byte(i)}, nil, nil); p == 1 {
+			break
+		}
+	}
+	<-inflight
+
+	// Workers 模式下等被回收分区处理中的消息完成后才回调 OnReleased
+	b.Release("topic_test", 1)
+	select {
+	case r := <-released:
+		t.Fatalf("released %v before in-flight message finished", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(unblock)
+	if got := <-released; len(got["topic_test"]) != 1 || got["topic_test"][0] != 1 {
+		t.Fatalf("released %v", got)
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []cluster.NotificationType{cluster.RebalanceStart, cluster.RebalanceOK, cluster.RebalanceStart, cluster.RebalanceOK}
+	if len(types) != len(want) {
+		t.Fatalf("notifications %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("notifications %v, want %v", types, want)
+		}
+	}
+}
+
+func TestKafComsumer_SyncCommit(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	for _, v := range []string{"a", "b", "c"} {
+		b.Produce("topic_test", nil, []byte(v), nil)
+	}
+
+	// 自动提交间隔足够长, 只有 SyncCommit 会提交
+	conf := cluster.NewConfig()
+	conf.Group.Return.Notifications = true
+	conf.Consumer.Offsets.Initial = sarama.OffsetOldest
+	conf.Consumer.Offsets.CommitInterval = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	var committed []int64
+	c := &kafka.KafComsumer{
+		Topics:  []string{"topic_test"},
+		GroupId: "group_id",
+		Conf:    conf,
+		Handler: kafka.HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			committed = append(committed, b.Committed("group_id", "topic_test", 0))
+			if len(committed) == 3 {
+				go func() {
+					b.WaitCommitted("group_id", "topic_test", 0, 3, 3*time.Second)
+					cancel()
+				}()
+			}
+			return nil
+		}),
+		SyncCommit: true,
+		Dial:       b.Dial,
+	}
+	runConsumer(ctx, t, c, cancel)
+
+	// 处理每条消息时上一条已经提交
+	if len(committed) != 3 || committed[0] != -1 || committed[1] != 1 || committed[2] != 2 {
+		t.Fatalf("committed before each message %v, want [-1 1 2]", committed)
+	}
+	if got := b.Committed("group_id", "topic_test", 0); got != 3 {
+		t.Fatalf("committed %d, want 3", got)
+	}
+}
+
+// testDedup Seen 对 seen 中的消息返回 true, Done 记录处理成功的消息
+type testDedup struct {
+	seen map[string]bool
+	done []string
+}
+
+func (d *testDedup) Seen(msg *sarama.ConsumerMessage) (bool, error) {
+	return d.seen[string(msg.Value)], nil
+}
+
+func (d *testDedup) Done(msg *sarama.ConsumerMessage) error {
+	d.done = append(d.done, string(msg.Value))
+	return nil
+}
+
+func TestKafComsumer_Dedup(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	for _, v := range []string{"a", "b", "c"} {
+		b.Produce("topic_test", nil, []byte(v), nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	h := &countHandler{n: 2, cancel: cancel}
+	dedup := &testDedup{seen: map[string]bool{"b": true}}
+	c := &kafka.KafComsumer{
+		Topics:     []string{"topic_test"},
+		GroupId:    "group_id",
+		Handler:    h,
+		SyncCommit: true,
+		Dedup:      dedup,
+		Dial:       b.Dial,
+	}
+	runConsumer(ctx, t, c, cancel)
+
+	if strings.Join(h.values, ",") != "a,c" || strings.Join(dedup.done, ",") != "a,c" {
+		t.Fatalf("handled %v done %v, want a,c", h.values, dedup.done)
+	}
+	// 跳过的重复消息也会 mark
+	if got := b.Committed("group_id", "topic_test", 0); got != 3 {
+		t.Fatalf("committed %d, want 3", got)
+	}
+}
+
+func TestKafComsumer_GiveUp(t *testing.T) {
+	dials := 0
+	c := &kafka.KafComsumer{
+		Topics:           []string{"topic_test"},
+		GroupId:          "group_id",
+		Handler:          &countHandler{},
+		OnError:          func(err error, transient bool) {},
+		Reconnects:       2,
+		ReconnectBackoff: time.Millisecond,
+		Dial: func(addr []string, groupId string, topics []string, conf *cluster.Config) (kafka.ClusterConsumer, error) {
+			dials++
+			return nil, sarama.ErrOutOfBrokers
+		},
+	}
+	err := c.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "give up after 2 reconnects") {
+		t.Fatalf("run error %v", err)
+	}
+	if dials != 3 {
+		t.Fatalf("dials %d, want 3", dials)
+	}
+
+	// 配置错误不重连
+	dials = 0
+	c.Dial = func(addr []string, groupId string, topics []string, conf *cluster.Config) (kafka.ClusterConsumer, error) {
+		dials++
+		return nil, sarama.ConfigurationError("bad config")
+	}
+	if err := c.Run(context.Background()); err != sarama.ConfigurationError("bad config") || dials != 1 {
+		t.Fatalf("run error %v dials %d", err, dials)
+	}
+}
+
+func TestKafProducer_Publish(t *testing.T) {
+	b := kafkatest.NewBroker(4)
+	p := &kafka.KafProducer{DialSync: b.SyncProducer, DialAsync: b.AsyncProducer}
+
+	partition, offset, err := p.Publish(&kafka.Message{
+		Topic:     "topic_test",
+		Value:     []byte("sync"),
+		Headers:   map[string]string{"k": "v"},
+		Manual:    true,
+		Partition: 3,
+	})
+	if err != nil || partition != 3 || offset != 0 {
+		t.Fatalf("publish partition:%d offset:%d err:%v", partition, offset, err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	p.OnSuccess = func(msg *kafka.Message, partition int32, offset int64) { wg.Done() }
+	if err := p.PublishAsync(&kafka.Message{Topic: "topic_test", Key: []byte("key"), Value: []byte("async")}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := b.Messages("topic_test")
+	if len(msgs) != 2 {
+		t.Fatalf("messages %d, want 2", len(msgs))
+	}
+	if _, _, err := p.Publish(&kafka.Message{Topic: "topic_test"}); err != kafka.ErrProducerClosed {
+		t.Fatalf("publish after close: %v", err)
+	}
+}
+
+// stalledProducer 在 release 关闭前不读取 Input, 模拟 sarama 发送队列积压
+type stalledProducer struct {
+	sarama.AsyncProducer
+	input chan *sarama.ProducerMessage
+	done  chan struct{}
+}
+
+func newStalledProducer(p sarama.AsyncProducer, release <-chan struct{}) *stalledProducer {
+	s := &stalledProducer{AsyncProducer: p, input: make(chan *sarama.ProducerMessage), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		<-release
+		for msg := range s.input {
+			p.Input() <- msg
+		}
+	}()
+	return s
+}
+
+func (s *stalledProducer) Input() chan<- *sarama.ProducerMessage { return s.input }
+
+func (s *stalledProducer) AsyncClose() {
+	close(s.input)
+	<-s.done
+	s.AsyncProducer.AsyncClose()
+}
+
+func TestKafProducer_StalledAsync(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	release := make(chan struct{})
+	p := &kafka.KafProducer{
+		DialSync: b.SyncProducer,
+		DialAsync: func(conf *sarama.Config) (sarama.AsyncProducer, error) {
+			ap, err := b.AsyncProducer(conf)
+			if err != nil {
+				return nil, err
+			}
+			return newStalledProducer(ap, release), nil
+		},
+	}
+
+	async := make(chan error, 1)
+	go func() { async <- p.PublishAsync(&kafka.Message{Topic: "topic_test", Value: []byte("async")}) }()
+	time.Sleep(10 * time.Millisecond)
+
+	// 异步发送阻塞时同步发送不受影响
+	published := make(chan error, 1)
+	go func() {
+		_, _, err := p.Publish(&kafka.Message{Topic: "topic_test", Value: []byte("sync")})
+		published <- err
+	}()
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sync publish blocked by stalled async publish")
+	}
+
+	// Close 等待阻塞中的异步发送写入后再关闭
+	closed := make(chan error, 1)
+	go func() { closed <- p.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("close returned before in-flight async publish")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if err := <-async; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if msgs := b.Messages("topic_test"); len(msgs) != 2 {
+		t.Fatalf("messages %d, want 2", len(msgs))
+	}
+	if err := p.PublishAsync(&kafka.Message{Topic: "topic_test"}); err != kafka.ErrProducerClosed {
+		t.Fatalf("publish async after close: %v", err)
+	}
+}
+
+type testMetrics struct {
+	mu       sync.Mutex
+	consumed int
+	errors   map[string]int
+	lag      map[int32]int64
+}
+
+func (m *testMetrics) Consumed(topic string, partition int32, n int) {
+	m.mu.Lock()
+	m.consumed += n
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) Latency(topic string, d time.Duration) {}
+
+func (m *testMetrics) Error(topic string, kind string) {
+	m.mu.Lock()
+	m.errors[kind]++
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) Lag(topic string, partition int32, lag int64) {
+	m.mu.Lock()
+	m.lag[partition] = lag
+	m.mu.Unlock()
+}
+
+func TestKafComsumer_Metrics(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	for _, v := range []string{"a", "bad", "c"} {
+		b.Produce("topic_test", nil, []byte(v), nil)
+	}
+
+	m := &testMetrics{errors: make(map[string]int), lag: make(map[int32]int64)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &kafka.KafComsumer{
+		Topics:  []string{"topic_test"},
+		GroupId: "group_id",
+		Handler: &countHandler{fail: func(msg *sarama.ConsumerMessage) bool {
+			return string(msg.Value) == "bad"
+		}},
+		OnFailure:       kafka.FailSkip,
+		Metrics:         m,
+		MetricsInterval: 5 * time.Millisecond,
+		Dial:            b.Dial,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mu.Lock()
+		lag, ok := m.lag[0]
+		done := m.consumed == 3 && ok && lag == 0
+		m.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics consumed:%d lag:%v", m.consumed, m.lag)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if m.errors[kafka.ErrorProcess] != 1 {
+		t.Fatalf("process errors %d, want 1", m.errors[kafka.ErrorProcess])
+	}
+}
+
+func TestKafComsumer_StuckLag(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	for _, v := range []string{"a", "b", "c", "d", "e"} {
+		b.Produce("topic_test", nil, []byte(v), nil)
+	}
+
+	// 第一条消息一直处理不完, 没有 mark 过的分区也要上报积压
+	m := &testMetrics{errors: make(map[string]int), lag: make(map[int32]int64)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &kafka.KafComsumer{
+		Topics:  []string{"topic_test"},
+		GroupId: "group_id",
+		Handler: kafka.HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+		Metrics:         m,
+		MetricsInterval: 5 * time.Millisecond,
+		Dial:            b.Dial,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mu.Lock()
+		lag, ok := m.lag[0]
+		m.mu.Unlock()
+		if ok && lag == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lag %v, want 5", m.lag)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowMetrics Lag 一直阻塞到 ctx 取消, 模拟上报很慢的监控
+type slowMetrics struct {
+	testMetrics
+	ctx     context.Context
+	once    sync.Once
+	lagging chan struct{}
+}
+
+func (m *slowMetrics) Lag(topic string, partition int32, lag int64) {
+	m.once.Do(func() { close(m.lagging) })
+	<-m.ctx.Done()
+}
+
+func TestKafComsumer_SlowMetrics(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	for _, v := range []string{"a", "b", "c"} {
+		b.Produce("topic_test", nil, []byte(v), nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &slowMetrics{ctx: ctx, lagging: make(chan struct{})}
+	c := &kafka.KafComsumer{
+		Topics:  []string{"topic_test"},
+		GroupId: "group_id",
+		Handler: kafka.HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			<-m.lagging
+			return nil
+		}),
+		Metrics:         m,
+		MetricsInterval: 5 * time.Millisecond,
+		Dial:            b.Dial,
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	// Lag 阻塞时消息仍然可以 mark 和提交
+	if !b.WaitCommitted("group_id", "topic_test", 0, 3, 5*time.Second) {
+		t.Error("offset not committed while metrics blocked")
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKafComsumer_PauseResume(t *testing.T) {
+	b := kafkatest.NewBroker(2)
+	for i := 0; i < 10; i++ {
+		b.Produce("topic_test", []byte{byte(i)}, []byte{byte(i)}, nil)
+	}
+	var paused int64
+	for _, msg := range b.Messages("topic_test") {
+		if msg.Partition == 0 {
+			paused++
+		}
+	}
+
+	// 没有 Workers 时所有分区共用一个消息通道, 不能只暂停一个分区
+	if err := (&kafka.KafComsumer{}).Pause("topic_test", 0); err != kafka.ErrPauseNoWorkers {
+		t.Fatalf("pause without workers: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	h := &countHandler{n: 10, cancel: cancel}
+	c := &kafka.KafComsumer{
+		Topics:    []string{"topic_test"},
+		GroupId:   "group_id",
+		Handler:   h,
+		Workers:   2,
+		RateLimit: 1000,
+		Dial:      b.Dial,
+	}
+	if err := c.Pause("topic_test", 0); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if !b.WaitCommitted("group_id", "topic_test", 1, 10-paused, 3*time.Second) {
+			t.Error("partition 1 not consumed while partition 0 paused")
+		}
+		if got := b.Committed("group_id", "topic_test", 0); got != -1 {
+			t.Errorf("paused partition committed %d", got)
+		}
+		c.Resume("topic_test", 0)
+	}()
+	runConsumer(ctx, t, c, cancel)
+
+	if len(h.values) != 10 {
+		t.Fatalf("handled %d messages, want 10", len(h.values))
+	}
+}
+
+func TestKafComsumer_Panic(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	b.Produce("topic_test", nil, []byte("panic"), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var panics []*kafka.PanicError
+	c := &kafka.KafComsumer{
+		Topics:  []string{"topic_test"},
+		GroupId: "group_id",
+		Handler: kafka.HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			panic(string(msg.Value))
+		}),
+		OnFailure:    kafka.FailRetry,
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		OnPanic:      func(err *kafka.PanicError) { panics = append(panics, err) },
+		Dial:         b.Dial,
+	}
+	err := c.Run(ctx)
+	perr, ok := err.(*kafka.ProcessError)
+	if !ok || perr.Attempts != 3 {
+		t.Fatalf("run error %v, want *ProcessError after 3 attempts", err)
+	}
+	if _, ok := perr.Err.(*kafka.PanicError); !ok {
+		t.Fatalf("process error %v, want *PanicError", perr.Err)
+	}
+	if len(panics) != 3 || panics[0].Value != "panic" || len(panics[0].Stack) == 0 {
+		t.Fatalf("panics %v", panics)
+	}
+}
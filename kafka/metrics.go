@@ -0,0 +1,165 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// Metrics.Error 的错误类型
+const (
+	ErrorProcess    = "process"     // Handler 返回 error 或 panic, 每次重试都会计数
+	ErrorDeadLetter = "dead_letter" // 写入死信 topic 的消息
+	ErrorBroker     = "broker"      // Errors() 中的 broker 错误
+)
+
+// Metrics 消费指标, 实现时对接 prometheus 等监控, 方法需要并发安全
+type Metrics interface {
+	// Consumed 处理成功并 mark 的消息数, 每秒消息数由监控按 rate 计算
+	Consumed(topic string, partition int32, n int)
+	// Latency 一次 Handler 调用的耗时, 批量模式为整批耗时
+	Latency(topic string, d time.Duration)
+	// Error 错误计数, kind 为 ErrorProcess / ErrorDeadLetter / ErrorBroker, broker 错误的 topic 可能为空
+	Error(topic string, kind string)
+	// Lag 分区积压的消息数, 即 high water mark 与已 mark offset 的差值, 每 MetricsInterval 上报一次;
+	// 还没有 mark 的分区从收到的第一条消息或者已提交的 offset 算起
+	Lag(topic string, partition int32, lag int64)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Consumed(topic string, partition int32, n int) {}
+func (nopMetrics) Latency(topic string, d time.Duration)         {}
+func (nopMetrics) Error(topic string, kind string)               {}
+func (nopMetrics) Lag(topic string, partition int32, lag int64)  {}
+
+func (c *KafComsumer) metrics() Metrics {
+	if c.Metrics == nil {
+		return nopMetrics{}
+	}
+	return c.Metrics
+}
+
+// marked 记录已 mark 的下一条 offset, 用于计算积压
+func (c *KafComsumer) marked(msg *sarama.ConsumerMessage) {
+	c.position(msg.Topic, msg.Partition, msg.Offset+1, false)
+}
+
+// received 收到分区的第一条消息时记录其 offset, 第一条消息处理卡住时积压从这里算起
+func (c *KafComsumer) received(msg *sarama.ConsumerMessage) {
+	c.position(msg.Topic, msg.Partition, msg.Offset, true)
+}
+
+// position 更新分区的消费位置, initial 为 true 时只在没有记录时设置
+func (c *KafComsumer) position(topic string, partition int32, offset int64, initial bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.offsets == nil {
+		c.offsets = make(map[string]map[int32]int64)
+	}
+	if c.offsets[topic] == nil {
+		c.offsets[topic] = make(map[int32]int64)
+	}
+	if cur, ok := c.offsets[topic][partition]; !ok || (!initial && offset > cur) {
+		c.offsets[topic][partition] = offset
+	}
+}
+
+// forget 分区被回收后删除消费位置, 再次分配时重新计算
+func (c *KafComsumer) forget(topic string, partition int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.offsets[topic], partition)
+}
+
+// reportLag 定时比较 sarama 维护的 high water mark 和消费位置, 直到 ctx 取消
+// 还没有收到消息的分区使用消费组已提交的 offset, 只有通过 Addr 连接时可以查询
+func (c *KafComsumer) reportLag(ctx context.Context, comsumer ClusterConsumer) {
+	interval := c.MetricsInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var admin *KafAdmin
+	if c.Dial == nil {
+		conf := c.Conf.Config
+		admin = &KafAdmin{Addr: c.Addr, Conf: &conf}
+		defer admin.Close()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// 持有 c.mu 时只复制消费位置, 解锁后再调用 Metrics, 上报慢时不阻塞 mark 和 Pause/Resume
+		hwms := comsumer.HighWaterMarks()
+		known := make(map[string]map[int32]int64)
+		c.mu.Lock()
+		for topic, partitions := range hwms {
+			for partition := range partitions {
+				if offset, ok := c.offsets[topic][partition]; ok {
+					if known[topic] == nil {
+						known[topic] = make(map[int32]int64)
+					}
+					known[topic][partition] = offset
+				}
+			}
+		}
+		c.mu.Unlock()
+
+		unknown := make(map[string]map[int32]int64)
+		for topic, partitions := range hwms {
+			for partition, hwm := range partitions {
+				offset, ok := known[topic][partition]
+				if !ok {
+					if unknown[topic] == nil {
+						unknown[topic] = make(map[int32]int64)
+					}
+					unknown[topic][partition] = hwm
+					continue
+				}
+				c.Metrics.Lag(topic, partition, lagOf(hwm, offset))
+			}
+		}
+
+		if admin == nil {
+			continue
+		}
+		for topic, partitions := range unknown {
+			offsets, err := admin.GroupOffsets(c.GroupId, topic)
+			if err != nil {
+				fmt.Printf("[ERROR] kafka lag group:%s topic:%s %s\n", c.GroupId, topic, err.Error())
+				continue
+			}
+			for _, o := range offsets {
+				hwm, ok := partitions[o.Partition]
+				if !ok {
+					continue
+				}
+				lag := o.Lag
+				if o.Committed >= 0 {
+					lag = lagOf(hwm, o.Committed)
+				} else if c.Conf.Consumer.Offsets.Initial == sarama.OffsetNewest {
+					lag = 0
+				}
+				c.Metrics.Lag(topic, o.Partition, lag)
+			}
+		}
+	}
+}
+
+func lagOf(hwm, offset int64) int64 {
+	if lag := hwm - offset; lag > 0 {
+		return lag
+	}
+	return 0
+}
@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// HandlerFunc 函数形式的 KafcHandler
+type HandlerFunc func(msg *sarama.ConsumerMessage) error
+
+// Handle 实现 KafcHandler
+func (f HandlerFunc) Handle(msg *sarama.ConsumerMessage) error {
+	return f(msg)
+}
+
+// Middleware 包装 KafcHandler, 用于日志、panic 恢复、链路追踪、监控等通用逻辑
+type Middleware func(KafcHandler) KafcHandler
+
+// Chain 依次用 mws 包装 h, mws[0] 在最外层
+func Chain(h KafcHandler, mws ...Middleware) KafcHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// DecodeError 消息解码失败
+type DecodeError struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("kafka decode topic:%s partition:%d offset:%d error:%v", e.Topic, e.Partition, e.Offset, e.Err)
+}
+
+// Decode 用 codec 把消息解码到 newValue() 返回的指针后交给 handle, 解码失败返回 *DecodeError
+//
+//	kafka.Decode(kafka.JSONCodec, func() interface{} { return new(Order) }, func(msg *sarama.ConsumerMessage, v interface{}) error {
+//		order := v.(*Order)
+//		...
+//	})
+func Decode(codec Codec, newValue func() interface{}, handle func(msg *sarama.ConsumerMessage, v interface{}) error) KafcHandler {
+	return HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+		v := newValue()
+		if err := codec.Unmarshal(msg.Value, v); err != nil {
+			return &DecodeError{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset, Err: err}
+		}
+		return handle(msg, v)
+	})
+}
+
+// PanicError Handler 发生 panic
+type PanicError struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Value     interface{} // recover() 的返回值
+	Stack     []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("kafka panic topic:%s partition:%d offset:%d: %v\n%s", e.Topic, e.Partition, e.Offset, e.Value, e.Stack)
+}
+
+// Recover 把 Handler 的 panic 转为 *PanicError 返回
+func Recover() Middleware {
+	return func(next KafcHandler) KafcHandler {
+		return HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			return protect(msg, func() error { return next.Handle(msg) }, nil)
+		})
+	}
+}
+
+// protect 调用 fn, panic 时转为 *PanicError 返回, onPanic 不为空时先回调
+func protect(msg *sarama.ConsumerMessage, fn func() error, onPanic func(err *PanicError)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr := &PanicError{
+				Topic:     msg.Topic,
+				Partition: msg.Partition,
+				Offset:    msg.Offset,
+				Value:     r,
+				Stack:     debug.Stack(),
+			}
+			if onPanic != nil {
+				onPanic(perr)
+			}
+			err = perr
+		}
+	}()
+	return fn()
+}
+
+// Logging 记录每条消息的处理耗时和错误, logf 为空时使用 fmt.Printf
+func Logging(logf func(format string, args ...interface{})) Middleware {
+	if logf == nil {
+		logf = func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		}
+	}
+	return func(next KafcHandler) KafcHandler {
+		return HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			start := time.Now()
+			err := next.Handle(msg)
+			if err != nil {
+				logf("[ERROR] kafka handle topic:%s partition:%d offset:%d cost:%s error:%v",
+					msg.Topic, msg.Partition, msg.Offset, time.Since(start), err)
+			} else {
+				logf("[INFO] kafka handle topic:%s partition:%d offset:%d cost:%s",
+					msg.Topic, msg.Partition, msg.Offset, time.Since(start))
+			}
+			return err
+		})
+	}
+}
+
+// Tracing 在处理前调用 start 开始一个 span, 处理完成后调用其返回的 finish
+// 可以从 msg.Headers 中取出上游传递的 trace 信息
+func Tracing(start func(msg *sarama.ConsumerMessage) (finish func(err error))) Middleware {
+	return func(next KafcHandler) KafcHandler {
+		return HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			finish := start(msg)
+			err := next.Handle(msg)
+			if finish != nil {
+				finish(err)
+			}
+			return err
+		})
+	}
+}
+
+// Instrument 向 m 上报 Handler 的耗时和错误, 用于 KafComsumer 以外单独使用 Handler 的场景
+func Instrument(m Metrics) Middleware {
+	return func(next KafcHandler) KafcHandler {
+		return HandlerFunc(func(msg *sarama.ConsumerMessage) error {
+			start := time.Now()
+			err := next.Handle(msg)
+			m.Latency(msg.Topic, time.Since(start))
+			if err != nil {
+				m.Error(msg.Topic, ErrorProcess)
+			}
+			return err
+		})
+	}
+}
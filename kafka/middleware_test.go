@@ -0,0 +1,54 @@
+package kafka_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/wthsjy/hswjywtgu2/kafka"
+)
+
+type order struct {
+	ID int `json:"id"`
+}
+
+func TestDecodeChain(t *testing.T) {
+	var traced []error
+	h := kafka.Chain(
+		kafka.Decode(kafka.JSONCodec, func() interface{} { return new(order) }, func(msg *sarama.ConsumerMessage, v interface{}) error {
+			if v.(*order).ID == 0 {
+				panic("empty order")
+			}
+			return nil
+		}),
+		kafka.Tracing(func(msg *sarama.ConsumerMessage) func(error) {
+			return func(err error) { traced = append(traced, err) }
+		}),
+		kafka.Recover(),
+	)
+
+	if err := h.Handle(&sarama.ConsumerMessage{Value: []byte(`{"id":1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	err := h.Handle(&sarama.ConsumerMessage{Value: []byte(`{`)})
+	if _, ok := err.(*kafka.DecodeError); !ok {
+		t.Fatalf("error %v, want *DecodeError", err)
+	}
+	err = h.Handle(&sarama.ConsumerMessage{Topic: "topic_test", Offset: 3, Value: []byte(`{}`)})
+	if perr, ok := err.(*kafka.PanicError); !ok || perr.Value != "empty order" || perr.Offset != 3 {
+		t.Fatalf("error %v, want *PanicError", err)
+	}
+	if len(traced) != 3 || traced[0] != nil || traced[1] == nil {
+		t.Fatalf("traced %v", traced)
+	}
+}
+
+func TestRawCodec(t *testing.T) {
+	var s string
+	if err := kafka.RawCodec.Unmarshal([]byte("raw"), &s); err != nil || s != "raw" {
+		t.Fatalf("raw codec %q %v", s, err)
+	}
+	if err := kafka.ProtoCodec.Unmarshal(nil, &s); err == nil {
+		t.Fatal(errors.New("proto codec accepted non proto.Message"))
+	}
+}
@@ -1,5 +1,254 @@
 package kafka
 
-func Publish() {
-	//TODO
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// ErrProducerClosed 生产者已关闭
+var ErrProducerClosed = errors.New("kafka producer closed")
+
+// Message kafka 生产消息
+type Message struct {
+	Topic     string
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string // 需要 kafka 0.11 及以上版本
+	Manual    bool              // 为 true 时写入 Partition 指定的分区, 否则按 Key 哈希选择分区
+	Partition int32
+}
+
+// KafProducer kafka 生产者, 同步和异步发送共用一个 sarama.Client, 并发安全
+type KafProducer struct {
+	Addr []string
+	Conf *sarama.Config
+
+	// OnSuccess 异步发送成功回调, 可为空
+	OnSuccess func(msg *Message, partition int32, offset int64)
+	// OnError 异步发送失败回调, 为空时打印错误
+	OnError func(msg *Message, err error)
+
+	// DialSync / DialAsync 创建底层生产者, 为空时使用 Addr 创建的共用 client, 测试时可以用 kafkatest 替换
+	DialSync  func(conf *sarama.Config) (sarama.SyncProducer, error)
+	DialAsync func(conf *sarama.Config) (sarama.AsyncProducer, error)
+
+	mu       sync.Mutex
+	closed   bool
+	conf     *sarama.Config
+	client   sarama.Client
+	sync     sarama.SyncProducer
+	async    sarama.AsyncProducer
+	inflight sync.WaitGroup // 正在写入 sarama 的 Publish / PublishAsync, Close 时等待
+	wg       sync.WaitGroup
+}
+
+func defaultProducerConfig() *sarama.Config {
+	conf := sarama.NewConfig()
+	conf.Version = sarama.V0_11_0_0
+	conf.Producer.RequiredAcks = sarama.WaitForAll
+	conf.Producer.Retry.Max = 3
+	return conf
+}
+
+// Publish 同步发送, 返回消息写入的分区和 offset
+func (p *KafProducer) Publish(msg *Message) (partition int32, offset int64, err error) {
+	producer, err := p.syncProducer()
+	if err != nil {
+		return
+	}
+	defer p.inflight.Done()
+	return producer.SendMessage(msg.encode())
+}
+
+// PublishAsync 异步发送, 发送结果通过 OnSuccess / OnError 回调
+// sarama 发送队列满时会阻塞, 不影响同时进行的 Publish
+func (p *KafProducer) PublishAsync(msg *Message) error {
+	producer, err := p.asyncProducer()
+	if err != nil {
+		return err
+	}
+	defer p.inflight.Done()
+	producer.Input() <- msg.encode()
+	return nil
+}
+
+// Close 关闭生产者, 会等待正在写入和异步发送中的消息完成
+func (p *KafProducer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	// closed 之后不会再有新的发送, 等已经开始的写完再关闭 Input
+	p.inflight.Wait()
+
+	var err error
+	if p.async != nil {
+		p.async.AsyncClose()
+		p.wg.Wait()
+	}
+	if p.sync != nil {
+		if e := p.sync.Close(); e != nil {
+			err = e
+		}
+	}
+	if p.client != nil {
+		if e := p.client.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// init 生成实际使用的配置, 未设置 Dial 时创建共用的 client, 调用方需持有 p.mu
+func (p *KafProducer) init() error {
+	if p.closed {
+		return ErrProducerClosed
+	}
+	if p.conf == nil {
+		if p.Conf == nil {
+			p.Conf = defaultProducerConfig()
+		}
+
+		// 同步发送依赖 Successes, 指定分区依赖自定义 partitioner
+		conf := *p.Conf
+		conf.Producer.Return.Successes = true
+		conf.Producer.Return.Errors = true
+		conf.Producer.Partitioner = newPartitioner(conf.Producer.Partitioner)
+		p.conf = &conf
+	}
+	if p.client != nil || (p.DialSync != nil && p.DialAsync != nil) {
+		return nil
+	}
+
+	client, err := sarama.NewClient(p.Addr, p.conf)
+	if err != nil {
+		fmt.Println(err.Error())
+		return err
+	}
+	p.client = client
+	return nil
+}
+
+// syncProducer 返回同步生产者并计入 inflight, 调用方发送完成后需调用 p.inflight.Done()
+func (p *KafProducer) syncProducer() (sarama.SyncProducer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	if p.sync == nil {
+		var producer sarama.SyncProducer
+		var err error
+		if p.DialSync != nil {
+			producer, err = p.DialSync(p.conf)
+		} else {
+			producer, err = sarama.NewSyncProducerFromClient(p.client)
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.sync = producer
+	}
+	p.inflight.Add(1)
+	return p.sync, nil
+}
+
+// asyncProducer 返回异步生产者并计入 inflight, 调用方写入 Input 后需调用 p.inflight.Done()
+func (p *KafProducer) asyncProducer() (sarama.AsyncProducer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	if p.async == nil {
+		var producer sarama.AsyncProducer
+		var err error
+		if p.DialAsync != nil {
+			producer, err = p.DialAsync(p.conf)
+		} else {
+			producer, err = sarama.NewAsyncProducerFromClient(p.client)
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.async = producer
+
+		p.wg.Add(2)
+		go p.drainSuccesses(producer)
+		go p.drainErrors(producer)
+	}
+	p.inflight.Add(1)
+	return p.async, nil
+}
+
+func (p *KafProducer) drainSuccesses(producer sarama.AsyncProducer) {
+	defer p.wg.Done()
+	for m := range producer.Successes() {
+		if p.OnSuccess != nil {
+			p.OnSuccess(m.Metadata.(*Message), m.Partition, m.Offset)
+		}
+	}
+}
+
+func (p *KafProducer) drainErrors(producer sarama.AsyncProducer) {
+	defer p.wg.Done()
+	for e := range producer.Errors() {
+		if p.OnError != nil {
+			p.OnError(e.Msg.Metadata.(*Message), e.Err)
+			continue
+		}
+		fmt.Printf("[ERROR] publish topic:%s %s\n", e.Msg.Topic, e.Err.Error())
+	}
+}
+
+func (m *Message) encode() *sarama.ProducerMessage {
+	pm := &sarama.ProducerMessage{
+		Topic:    m.Topic,
+		Value:    sarama.ByteEncoder(m.Value),
+		Metadata: m,
+	}
+	if m.Key != nil {
+		pm.Key = sarama.ByteEncoder(m.Key)
+	}
+	for k, v := range m.Headers {
+		pm.Headers = append(pm.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	return pm
+}
+
+// partitioner 对 Manual 消息使用指定分区, 其余交给原 partitioner
+type partitioner struct {
+	sarama.Partitioner
+}
+
+func newPartitioner(base sarama.PartitionerConstructor) sarama.PartitionerConstructor {
+	if base == nil {
+		base = sarama.NewHashPartitioner
+	}
+	return func(topic string) sarama.Partitioner {
+		return &partitioner{Partitioner: base(topic)}
+	}
+}
+
+func (p *partitioner) Partition(message *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if m, ok := message.Metadata.(*Message); ok && m.Manual {
+		if m.Partition < 0 || m.Partition >= numPartitions {
+			return -1, sarama.ErrInvalidPartition
+		}
+		return m.Partition, nil
+	}
+	return p.Partitioner.Partition(message, numPartitions)
+}
+
+func (p *partitioner) RequiresConsistency() bool {
+	return true
 }
@@ -0,0 +1,79 @@
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// seek 加入消费组前按 StartOffsets / StartTime 为还没有提交过 offset 的分区提交起始 offset,
+// 加入后 sarama-cluster 直接从提交的 offset 拉取; 已提交过的分区不受影响
+// 消费组已有在线成员时 broker 不接受组外的提交, 起始 offset 由最先启动的实例提交, 这里只打印警告
+func (c *KafComsumer) seek() error {
+	if c.StartAt == sarama.OffsetNewest {
+		c.Conf.Consumer.Offsets.Initial = sarama.OffsetNewest
+	}
+	if c.StartTime.IsZero() && len(c.StartOffsets) == 0 {
+		return nil
+	}
+
+	// 按时间查询 offset 需要 0.10.1 及以上版本的协议
+	conf := c.Conf.Config
+	if !conf.Version.IsAtLeast(sarama.V0_10_1_0) {
+		conf.Version = sarama.V0_10_1_0
+	}
+	admin := &KafAdmin{Addr: c.Addr, Conf: &conf}
+	defer admin.Close()
+
+	for _, topic := range c.Topics {
+		offsets, err := c.startOffsets(admin, topic)
+		if err != nil {
+			return fmt.Errorf("kafka comsumer start group:%s topic:%s error:%v", c.GroupId, topic, err)
+		}
+		if len(offsets) == 0 {
+			continue
+		}
+		err = admin.CommitOffsets(c.GroupId, topic, offsets)
+		if err == ErrGroupActive {
+			fmt.Printf("[WARN] kafka comsumer start group:%s topic:%s skipped, group has active members\n", c.GroupId, topic)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("kafka comsumer start group:%s topic:%s error:%v", c.GroupId, topic, err)
+		}
+		fmt.Printf("[INFO] kafka comsumer start group:%s topic:%s offsets:%v\n", c.GroupId, topic, offsets)
+	}
+	return nil
+}
+
+// startOffsets 没有提交过 offset 的分区的起始 offset, 没有 StartOffsets 也没有 StartTime 的分区由 Initial 决定
+func (c *KafComsumer) startOffsets(admin *KafAdmin, topic string) (map[int32]int64, error) {
+	current, err := admin.GroupOffsets(c.GroupId, topic)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[int32]int64)
+	for _, o := range current {
+		if o.Committed >= 0 {
+			continue
+		}
+		if offset, ok := c.StartOffsets[topic][o.Partition]; ok {
+			offsets[o.Partition] = offset
+			continue
+		}
+		if c.StartTime.IsZero() {
+			continue
+		}
+		client, err := admin.getClient()
+		if err != nil {
+			return nil, err
+		}
+		offset, err := offsetAt(client, topic, o.Partition, c.StartTime.UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+		offsets[o.Partition] = offset
+	}
+	return offsets, nil
+}
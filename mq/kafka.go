@@ -0,0 +1,60 @@
+package mq
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Shopify/sarama"
+	"github.com/wthsjy/hswjywtgu2/kafka"
+)
+
+// KafkaPublisher 通过 kafka.KafProducer 同步发送, Key 决定分区
+type KafkaPublisher struct {
+	Producer *kafka.KafProducer
+}
+
+// Publish ctx 已取消时不发送; 发送后阻塞到 broker 确认, 最长为 sarama Producer.Timeout 加重试时间, 不受 ctx 控制
+func (p *KafkaPublisher) Publish(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, _, err := p.Producer.Publish(&kafka.Message{
+		Topic:   msg.Topic,
+		Key:     msg.Key,
+		Value:   msg.Body,
+		Headers: msg.Headers,
+	})
+	return err
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.Producer.Close()
+}
+
+// KafkaSubscriber 每次 Subscribe 通过 New 创建 kafka.KafComsumer 消费,
+// Nack 或返回 error 时按 KafComsumer.OnFailure 处理
+type KafkaSubscriber struct {
+	// New 返回配置好 Addr/GroupId/OnFailure 等的消费者, Topics 和 Handler 由 Subscribe 设置
+	New func() *kafka.KafComsumer
+}
+
+func (s *KafkaSubscriber) Subscribe(ctx context.Context, topic string, h Handler) error {
+	if s.New == nil {
+		return errors.New("mq KafkaSubscriber.New is nil")
+	}
+	c := s.New()
+	c.Topics = []string{topic}
+	c.Handler = kafka.HandlerFunc(func(m *sarama.ConsumerMessage) error {
+		msg := &Message{Topic: m.Topic, Key: m.Key, Body: m.Value}
+		if len(m.Headers) > 0 {
+			msg.Headers = make(map[string]string, len(m.Headers))
+			for _, rh := range m.Headers {
+				if rh != nil {
+					msg.Headers[string(rh.Key)] = string(rh.Value)
+				}
+			}
+		}
+		return handle(h, msg)
+	})
+	return c.Run(ctx)
+}
@@ -0,0 +1,146 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrMemoryClosed Memory 已关闭
+var ErrMemoryClosed = errors.New("mq memory closed")
+
+// Memory 内存实现, 同时是 Publisher 和 Subscriber, 用于单元测试
+// 每个 topic 一个队列, 订阅前发送的消息会保留; 同一 topic 的多个订阅者竞争消费,
+// 处理失败或 panic 的消息等待 RedeliveryDelay 后放回队尾重新投递
+type Memory struct {
+	// RedeliveryDelay 处理失败后重新投递前的等待时间, 默认 10ms, 避免一直失败的消息占满 CPU
+	RedeliveryDelay time.Duration
+
+	mu      sync.Mutex
+	closed  bool
+	queues  map[string][]*Message
+	changed chan struct{} // 有新消息或关闭时关闭并替换
+}
+
+// NewMemory 创建内存 broker
+func NewMemory() *Memory {
+	return &Memory{
+		queues:  make(map[string][]*Message),
+		changed: make(chan struct{}),
+	}
+}
+
+// Publish 复制消息写入 msg.Topic 队列
+func (m *Memory) Publish(ctx context.Context, msg *Message) error {
+	cp := &Message{Topic: msg.Topic, Key: msg.Key, Body: msg.Body}
+	if msg.Headers != nil {
+		cp.Headers = make(map[string]string, len(msg.Headers))
+		for k, v := range msg.Headers {
+			cp.Headers[k] = v
+		}
+	}
+	return m.push(cp)
+}
+
+// Pending 返回 topic 队列中等待投递的消息数
+func (m *Memory) Pending(topic string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queues[topic])
+}
+
+// Subscribe 消费 topic 队列, 直到 ctx 取消或 Close
+func (m *Memory) Subscribe(ctx context.Context, topic string, h Handler) error {
+	for ctx.Err() == nil {
+		msg, err := m.pop(ctx, topic)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if m.handle(h, msg) != nil {
+			delay := m.RedeliveryDelay
+			if delay <= 0 {
+				delay = 10 * time.Millisecond
+			}
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+			case <-t.C:
+			}
+			t.Stop()
+			// 重新投递时是一条新消息, 需要重新 Ack/Nack; ctx 取消时也放回, 不丢消息
+			m.push(&Message{Topic: msg.Topic, Key: msg.Key, Body: msg.Body, Headers: msg.Headers})
+		}
+	}
+	return nil
+}
+
+// handle 调用 h, panic 时打印堆栈并视为处理失败
+func (m *Memory) handle(h Handler, msg *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("mq memory panic topic:%s: %v", msg.Topic, r)
+			fmt.Printf("[ERROR] %s\n%s\n", err.Error(), debug.Stack())
+		}
+	}()
+	return handle(h, msg)
+}
+
+// Close 关闭后 Publish 返回 ErrMemoryClosed, Subscribe 返回 ErrMemoryClosed
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		m.broadcast()
+	}
+	return nil
+}
+
+func (m *Memory) push(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrMemoryClosed
+	}
+	m.queues[msg.Topic] = append(m.queues[msg.Topic], msg)
+	m.broadcast()
+	return nil
+}
+
+func (m *Memory) pop(ctx context.Context, topic string) (*Message, error) {
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, ErrMemoryClosed
+		}
+		if q := m.queues[topic]; len(q) > 0 {
+			msg := q[0]
+			m.queues[topic] = q[1:]
+			m.mu.Unlock()
+			return msg, nil
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// broadcast 调用方需持有 m.mu
+func (m *Memory) broadcast() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
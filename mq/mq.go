@@ -0,0 +1,86 @@
+// Package mq 与具体 broker 无关的消息接口, kafka / rabbitmq / 内存实现可以互相替换
+//
+//	var pub mq.Publisher = &mq.KafkaPublisher{Producer: &kafka.KafProducer{Addr: addr}}
+//	var sub mq.Subscriber = mq.NewMemory() // 单元测试
+//	sub.Subscribe(ctx, "topic", func(msg *mq.Message) error { ... })
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrNacked Handler 调用了 Message.Nack
+var ErrNacked = errors.New("mq message nacked")
+
+// Message 通用消息
+// Topic 在 kafka 中为 topic, 在 rabbitmq 中发送时为 routing key, 接收时为队列名
+type Message struct {
+	Topic   string
+	Key     []byte
+	Body    []byte
+	Headers map[string]string
+
+	mu    sync.Mutex
+	state int // 0 未确认, 1 Ack, 2 Nack
+}
+
+// Ack 确认消息处理成功, 优先于 Handler 的返回值
+func (m *Message) Ack() {
+	m.settle(1)
+}
+
+// Nack 确认消息处理失败, 按各实现的失败策略重新投递, 优先于 Handler 的返回值
+func (m *Message) Nack() {
+	m.settle(2)
+}
+
+func (m *Message) settle(state int) {
+	m.mu.Lock()
+	if m.state == 0 {
+		m.state = state
+	}
+	m.mu.Unlock()
+}
+
+// Handler 消息处理函数, 没有调用 Ack/Nack 时返回 nil 视为 Ack, 返回 error 视为 Nack
+type Handler func(msg *Message) error
+
+// Publisher 发送消息, 并发安全
+type Publisher interface {
+	Publish(ctx context.Context, msg *Message) error
+	Close() error
+}
+
+// Subscriber 订阅 topic, Subscribe 阻塞到 ctx 取消(返回 nil)或出错
+type Subscriber interface {
+	Subscribe(ctx context.Context, topic string, h Handler) error
+}
+
+// handle 调用 h 并按 Ack/Nack 和返回值得出结果, nil 表示 Ack
+func handle(h Handler, msg *Message) error {
+	err := h(msg)
+	msg.mu.Lock()
+	state := msg.state
+	msg.mu.Unlock()
+
+	switch state {
+	case 1:
+		return nil
+	case 2:
+		if err == nil {
+			err = ErrNacked
+		}
+	}
+	return err
+}
+
+var (
+	_ Publisher  = (*Memory)(nil)
+	_ Subscriber = (*Memory)(nil)
+	_ Publisher  = (*KafkaPublisher)(nil)
+	_ Subscriber = (*KafkaSubscriber)(nil)
+	_ Publisher  = (*RabbitPublisher)(nil)
+	_ Subscriber = (*RabbitSubscriber)(nil)
+)
@@ -0,0 +1,107 @@
+package mq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wthsjy/hswjywtgu2/kafka"
+	"github.com/wthsjy/hswjywtgu2/kafka/kafkatest"
+	"github.com/wthsjy/hswjywtgu2/mq"
+)
+
+// consume 发送 a, b 两条消息, 第一次收到 a 时 Nack, 返回收到的消息
+func consume(t *testing.T, pub mq.Publisher, sub mq.Subscriber) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, v := range []string{"a", "b"} {
+		msg := &mq.Message{Topic: "topic_test", Key: []byte(v), Body: []byte(v), Headers: map[string]string{"h": v}}
+		if err := pub.Publish(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	nacked := false
+	err := sub.Subscribe(ctx, "topic_test", func(msg *mq.Message) error {
+		if string(msg.Body) == "a" && !nacked {
+			nacked = true
+			msg.Nack()
+			return nil
+		}
+		if string(msg.Key) != string(msg.Body) || msg.Headers["h"] != string(msg.Body) {
+			return errors.New("bad message")
+		}
+		got = append(got, string(msg.Body))
+		if len(got) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestMemory(t *testing.T) {
+	m := mq.NewMemory()
+	got := consume(t, m, m)
+	if len(got) != 2 || got[0] != "b" || got[1] != "a" {
+		t.Fatalf("got %v, want [b a]", got)
+	}
+	if m.Pending("topic_test") != 0 {
+		t.Fatalf("pending %d", m.Pending("topic_test"))
+	}
+}
+
+func TestMemory_Redeliver(t *testing.T) {
+	m := mq.NewMemory()
+	m.RedeliveryDelay = 20 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.Publish(ctx, &mq.Message{Topic: "topic_test", Body: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次 panic, 之后一直失败, 按 RedeliveryDelay 间隔重新投递
+	calls := 0
+	err := m.Subscribe(ctx, "topic_test", func(msg *mq.Message) error {
+		if calls++; calls == 1 {
+			panic("boom")
+		}
+		return errors.New("bad message")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls < 2 || calls > 6 {
+		t.Fatalf("handled %d times in 100ms, want redelivery every 20ms", calls)
+	}
+	if m.Pending("topic_test") != 1 {
+		t.Fatalf("pending %d, want failed message kept", m.Pending("topic_test"))
+	}
+}
+
+func TestKafka(t *testing.T) {
+	b := kafkatest.NewBroker(1)
+	pub := &mq.KafkaPublisher{Producer: &kafka.KafProducer{DialSync: b.SyncProducer, DialAsync: b.AsyncProducer}}
+	defer pub.Close()
+	sub := &mq.KafkaSubscriber{New: func() *kafka.KafComsumer {
+		return &kafka.KafComsumer{GroupId: "group_id", RetryBackoff: time.Millisecond, Dial: b.Dial}
+	}}
+	got := consume(t, pub, sub)
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("got %v, want [a b]", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pub.Publish(ctx, &mq.Message{Topic: "topic_test", Body: []byte("c")}); err != context.Canceled {
+		t.Fatalf("publish with cancelled ctx: %v", err)
+	}
+	if msgs := b.Messages("topic_test"); len(msgs) != 2 {
+		t.Fatalf("messages %d, want 2", len(msgs))
+	}
+}
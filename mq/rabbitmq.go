@@ -0,0 +1,69 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+	"github.com/wthsjy/hswjywtgu2/rabbitmq"
+)
+
+// HeaderKey rabbitmq 没有消息 key, 通过该 header 传递 Message.Key
+const HeaderKey = "x-message-key"
+
+// RabbitPublisher 通过 rabbitmq.RabProducer 发送到 Exchange, Topic 作为 routing key
+type RabbitPublisher struct {
+	Producer *rabbitmq.RabProducer
+	Exchange string
+}
+
+func (p *RabbitPublisher) Publish(ctx context.Context, msg *Message) error {
+	headers := make(amqp.Table, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if msg.Key != nil {
+		headers[HeaderKey] = string(msg.Key)
+	}
+	return p.Producer.Publish(ctx, &rabbitmq.Message{
+		Exchange:   p.Exchange,
+		RoutingKey: msg.Topic,
+		Body:       msg.Body,
+		Headers:    headers,
+	})
+}
+
+func (p *RabbitPublisher) Close() error {
+	return p.Producer.Close()
+}
+
+// RabbitSubscriber 每次 Subscribe 通过 New 创建 rabbitmq.RabComsumer 消费 topic 同名队列,
+// Nack 或返回 error 时按 RabComsumer 的 NoRequeue / Retry 处理
+type RabbitSubscriber struct {
+	// New 返回配置好 URL/Bindings/Concurrency 等的消费者, Queue 和 Handler 由 Subscribe 设置
+	New func() *rabbitmq.RabComsumer
+}
+
+func (s *RabbitSubscriber) Subscribe(ctx context.Context, topic string, h Handler) error {
+	if s.New == nil {
+		return errors.New("mq RabbitSubscriber.New is nil")
+	}
+	c := s.New()
+	c.Queue = topic
+	c.Handler = rabbitmq.HandlerFunc(func(d *amqp.Delivery) error {
+		msg := &Message{Topic: topic, Body: d.Body}
+		if len(d.Headers) > 0 {
+			msg.Headers = make(map[string]string, len(d.Headers))
+			for k, v := range d.Headers {
+				if k == HeaderKey {
+					msg.Key = []byte(fmt.Sprint(v))
+					continue
+				}
+				msg.Headers[k] = fmt.Sprint(v)
+			}
+		}
+		return handle(h, msg)
+	})
+	return c.Run(ctx)
+}
@@ -0,0 +1,956 @@
+package rabbitmq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker 内存中的 AMQP 0-9-1 broker, 只实现 RabProducer / RabComsumer / RPC 用到的方法:
+// 交换机和队列声明、绑定、qos、消费、ack/nack、publisher confirm、mandatory 退回和 direct reply-to
+// 队列参数不同的重复声明返回 PRECONDITION_FAILED, 不模拟 TTL 和死信
+type testBroker struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu        sync.Mutex
+	exchanges map[string]string // name -> kind
+	bindings  map[string][]testBinding
+	queues    map[string]*testQueue
+	conns     map[*testConn]struct{}
+	replies   map[string]*testChannel // direct reply-to token -> channel
+	seq       int
+}
+
+type testBinding struct {
+	queue, key string
+}
+
+type testQueue struct {
+	name      string
+	args      []byte
+	msgs      []*testMessage
+	consumers []*testConsumer
+	next      int
+}
+
+type testMessage struct {
+	exchange, key string
+	props         []byte // header frame 中 body size 之后的 property flags 和 properties
+	body          []byte
+	redelivered   bool
+}
+
+type testConsumer struct {
+	ch    *testChannel
+	queue string
+	tag   string
+	noAck bool
+}
+
+type testUnacked struct {
+	queue string
+	msg   *testMessage
+}
+
+type testConn struct {
+	b    *testBroker
+	nc   net.Conn
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+
+	channels map[uint16]*testChannel // 只在读 goroutine 中修改, 其余访问持有 b.mu
+}
+
+type testChannel struct {
+	c        *testConn
+	id       uint16
+	closing  bool
+	confirm  bool
+	pubSeq   uint64
+	tag      uint64
+	prefetch int
+	unacked  map[uint64]testUnacked
+	reply    string // direct reply-to token
+	replyTag string
+
+	// 正在接收内容的 basic.publish
+	pub      *testMessage
+	pubSize  uint64
+	pubMand  bool
+	pubReady bool
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{
+		t:         t,
+		ln:        ln,
+		exchanges: map[string]string{"": "direct"},
+		bindings:  make(map[string][]testBinding),
+		queues:    make(map[string]*testQueue),
+		conns:     make(map[*testConn]struct{}),
+		replies:   make(map[string]*testChannel),
+	}
+	go b.accept()
+	return b
+}
+
+func (b *testBroker) URL() string {
+	return "amqp://guest:guest@" + b.ln.Addr().String() + "/"
+}
+
+// Close 停止监听并断开所有连接
+func (b *testBroker) Close() {
+	b.ln.Close()
+	b.Drop()
+}
+
+// Drop 断开所有连接, 模拟网络故障, 之后仍可以重新连接
+func (b *testBroker) Drop() {
+	b.mu.Lock()
+	conns := make([]*testConn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+// Publish 通过默认交换机直接写入队列
+func (b *testBroker) Publish(queue string, body string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queues[queue]
+	if q == nil {
+		b.t.Errorf("test broker publish to missing queue %s", queue)
+		return
+	}
+	q.msgs = append(q.msgs, &testMessage{key: queue, props: []byte{0, 0}, body: []byte(body)})
+	b.dispatch(q)
+}
+
+// Ready 队列中等待投递的消息
+func (b *testBroker) Ready(queue string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var bodies []string
+	if q := b.queues[queue]; q != nil {
+		for _, m := range q.msgs {
+			bodies = append(bodies, string(m.body))
+		}
+	}
+	return bodies
+}
+
+// Consumers 队列上的消费者数, 队列不存在时返回 -1
+func (b *testBroker) Consumers(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q := b.queues[queue]; q != nil {
+		return len(q.consumers)
+	}
+	return -1
+}
+
+// Conns 当前的连接数
+func (b *testBroker) Conns() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+// DeleteQueue 删除队列, 队列上的消费者收到 basic.cancel, 之后发送到该队列的消息不可路由
+func (b *testBroker) DeleteQueue(queue string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q := b.queues[queue]; q != nil {
+		for _, cs := range q.consumers {
+			tag := cs.tag
+			cs.ch.c.send(method(cs.ch.id, mBasicCancel, func(w *argWriter) {
+				w.shortstr(tag)
+				w.octet(1) // no-wait
+			}))
+		}
+	}
+	delete(b.queues, queue)
+}
+
+// DeclareQueue 直接声明队列, args 为 nil 时与客户端不带参数的声明一致
+func (b *testBroker) DeclareQueue(queue string, args []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if args == nil {
+		args = []byte{0, 0, 0, 0}
+	}
+	b.queues[queue] = &testQueue{name: queue, args: args}
+}
+
+// waitFor 等待 cond 成立, 超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func (b *testBroker) accept() {
+	for {
+		nc, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &testConn{b: b, nc: nc, out: make(chan []byte, 1024), done: make(chan struct{}), channels: make(map[uint16]*testChannel)}
+		b.mu.Lock()
+		b.conns[c] = struct{}{}
+		b.mu.Unlock()
+		go c.write()
+		go c.serve()
+	}
+}
+
+// AMQP 帧类型和结束标志
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+	testFrameMax   = 4096
+)
+
+// amqp 方法 class << 16 | method
+const (
+	mConnStart       = 10<<16 | 10
+	mConnStartOk     = 10<<16 | 11
+	mConnTune        = 10<<16 | 30
+	mConnTuneOk      = 10<<16 | 31
+	mConnOpen        = 10<<16 | 40
+	mConnOpenOk      = 10<<16 | 41
+	mConnClose       = 10<<16 | 50
+	mConnCloseOk     = 10<<16 | 51
+	mChanOpen        = 20<<16 | 10
+	mChanOpenOk      = 20<<16 | 11
+	mChanClose       = 20<<16 | 40
+	mChanCloseOk     = 20<<16 | 41
+	mExchDeclare     = 40<<16 | 10
+	mExchDeclareOk   = 40<<16 | 11
+	mQueueDeclare    = 50<<16 | 10
+	mQueueDeclareOk  = 50<<16 | 11
+	mQueueBind       = 50<<16 | 20
+	mQueueBindOk     = 50<<16 | 21
+	mBasicQos        = 60<<16 | 10
+	mBasicQosOk      = 60<<16 | 11
+	mBasicConsume    = 60<<16 | 20
+	mBasicConsumeOk  = 60<<16 | 21
+	mBasicCancel     = 60<<16 | 30
+	mBasicCancelOk   = 60<<16 | 31
+	mBasicPublish    = 60<<16 | 40
+	mBasicReturn     = 60<<16 | 50
+	mBasicDeliver    = 60<<16 | 60
+	mBasicAck        = 60<<16 | 80
+	mBasicReject     = 60<<16 | 90
+	mBasicNack       = 60<<16 | 120
+	mConfirmSelect   = 85<<16 | 10
+	mConfirmSelectOk = 85<<16 | 11
+)
+
+// replyTo 前缀, 发送到 replyTo + "." + token 的消息直接投递给对应 channel 的消费者
+const testReplyPrefix = replyTo + "."
+
+// argReader 读取方法参数
+type argReader struct {
+	b   []byte
+	err error
+}
+
+func (r *argReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *argReader) octet() byte             { return r.next(1)[0] }
+func (r *argReader) short() uint16           { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *argReader) long() uint32            { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *argReader) longlong() uint64        { return binary.BigEndian.Uint64(r.next(8)) }
+func (r *argReader) shortstr() string        { return string(r.next(int(r.octet()))) }
+func (r *argReader) longstr() string         { return string(r.next(int(r.long()))) }
+func (r *argReader) bit(v byte, i uint) bool { return v&(1<<i) != 0 }
+
+// table 返回包含长度的原始字节, 用于比较队列参数
+func (r *argReader) table() []byte {
+	n := r.long()
+	raw := make([]byte, 4+n)
+	binary.BigEndian.PutUint32(raw, n)
+	copy(raw[4:], r.next(int(n)))
+	return raw
+}
+
+// sameTable 比较两个 table 的内容, 客户端按 map 顺序编码, 不能直接比较字节
+func sameTable(a, b []byte) bool {
+	ma, mb := tableFields(a), tableFields(b)
+	if ma == nil || mb == nil || len(ma) != len(mb) {
+		return false
+	}
+	for k, v := range ma {
+		if w, ok := mb[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// tableFields 把 table 拆成 key -> 类型和值的原始字节, 格式错误时返回 nil
+func tableFields(raw []byte) map[string]string {
+	fields := make(map[string]string)
+	ar := &argReader{b: raw}
+	ar = &argReader{b: ar.next(int(ar.long()))}
+	for len(ar.b) > 0 && ar.err == nil {
+		key := ar.shortstr()
+		start := ar.b
+		var n int
+		switch kind := ar.octet(); kind {
+		case 't', 'b', 'B':
+			n = 1
+		case 's', 'u':
+			n = 2
+		case 'I', 'i', 'f':
+			n = 4
+		case 'D':
+			n = 5
+		case 'l', 'L', 'd', 'T':
+			n = 8
+		case 'V':
+		case 'S', 'A', 'F', 'x':
+			n = int(ar.long())
+		default:
+			return nil
+		}
+		ar.next(n)
+		fields[key] = string(start[:len(start)-len(ar.b)])
+	}
+	if ar.err != nil {
+		return nil
+	}
+	return fields
+}
+
+// argWriter 写方法参数
+type argWriter struct {
+	bytes.Buffer
+}
+
+func (w *argWriter) octet(v byte)      { w.WriteByte(v) }
+func (w *argWriter) short(v uint16)    { binary.Write(w, binary.BigEndian, v) }
+func (w *argWriter) long(v uint32)     { binary.Write(w, binary.BigEndian, v) }
+func (w *argWriter) longlong(v uint64) { binary.Write(w, binary.BigEndian, v) }
+func (w *argWriter) shortstr(v string) { w.octet(byte(len(v))); w.WriteString(v) }
+func (w *argWriter) longstr(v string)  { w.long(uint32(len(v))); w.WriteString(v) }
+func (w *argWriter) emptyTable()       { w.long(0) }
+
+func frame(typ byte, channel uint16, payload []byte) []byte {
+	f := make([]byte, 7, 8+len(payload))
+	f[0] = typ
+	binary.BigEndian.PutUint16(f[1:], channel)
+	binary.BigEndian.PutUint32(f[3:], uint32(len(payload)))
+	f = append(f, payload...)
+	return append(f, frameEnd)
+}
+
+func method(channel uint16, id uint32, args func(w *argWriter)) []byte {
+	w := &argWriter{}
+	w.long(id)
+	if args != nil {
+		args(w)
+	}
+	return frame(frameMethod, channel, w.Bytes())
+}
+
+// content 方法之后的 header 帧和 body 帧
+func content(channel uint16, msg *testMessage) [][]byte {
+	w := &argWriter{}
+	w.short(60)
+	w.short(0)
+	w.longlong(uint64(len(msg.body)))
+	w.Write(msg.props)
+	frames := [][]byte{frame(frameHeader, channel, w.Bytes())}
+	for body := msg.body; len(body) > 0; {
+		n := len(body)
+		if n > testFrameMax-8 {
+			n = testFrameMax - 8
+		}
+		frames = append(frames, frame(frameBody, channel, body[:n]))
+		body = body[n:]
+	}
+	return frames
+}
+
+func (c *testConn) send(frames ...[]byte) {
+	for _, f := range frames {
+		select {
+		case c.out <- f:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *testConn) write() {
+	for {
+		select {
+		case f := <-c.out:
+			if _, err := c.nc.Write(f); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close 断开连接, 未 ack 的消息重新入队
+func (c *testConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.nc.Close()
+
+		c.b.mu.Lock()
+		defer c.b.mu.Unlock()
+		delete(c.b.conns, c)
+		for _, ch := range c.channels {
+			c.b.closeChannel(ch)
+		}
+	})
+}
+
+// closeConn 发送 connection.close 后断开
+func (c *testConn) closeConn(code uint16, text string, id uint32) {
+	c.send(method(0, mConnClose, func(w *argWriter) {
+		w.short(code)
+		w.shortstr(text)
+		w.short(uint16(id >> 16))
+		w.short(uint16(id))
+	}))
+	time.AfterFunc(100*time.Millisecond, c.close)
+}
+
+func (c *testConn) serve() {
+	defer c.close()
+	r := bufio.NewReader(c.nc)
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+	c.send(method(0, mConnStart, func(w *argWriter) {
+		w.octet(0)
+		w.octet(9)
+		w.emptyTable()
+		w.longstr("PLAIN")
+		w.longstr("en_US")
+	}))
+
+	for {
+		h := make([]byte, 7)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(h[3:])+1)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		if payload[len(payload)-1] != frameEnd {
+			return
+		}
+		payload = payload[:len(payload)-1]
+		channel := binary.BigEndian.Uint16(h[1:])
+
+		switch h[0] {
+		case frameHeartbeat:
+		case frameMethod:
+			ar := &argReader{b: payload}
+			id := ar.long()
+			if channel == 0 {
+				if !c.connMethod(id, ar) {
+					return
+				}
+				continue
+			}
+			c.channelMethod(channel, id, ar)
+		case frameHeader, frameBody:
+			c.b.mu.Lock()
+			ch := c.channels[channel]
+			if ch != nil && !ch.closing {
+				c.b.content(ch, h[0], payload)
+			}
+			c.b.mu.Unlock()
+		default:
+			return
+		}
+	}
+}
+
+// connMethod 处理 channel 0 上的方法, 返回 false 时断开
+func (c *testConn) connMethod(id uint32, ar *argReader) bool {
+	switch id {
+	case mConnStartOk:
+		c.send(method(0, mConnTune, func(w *argWriter) {
+			w.short(0)
+			w.long(testFrameMax)
+			w.short(0)
+		}))
+	case mConnTuneOk:
+	case mConnOpen:
+		c.send(method(0, mConnOpenOk, func(w *argWriter) { w.shortstr("") }))
+	case mConnClose:
+		c.send(method(0, mConnCloseOk, nil))
+		time.AfterFunc(100*time.Millisecond, c.close)
+	case mConnCloseOk:
+		return false
+	default:
+		c.closeConn(540, "NOT_IMPLEMENTED", id)
+	}
+	return true
+}
+
+func (c *testConn) channelMethod(channel uint16, id uint32, ar *argReader) {
+	b := c.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := c.channels[channel]
+	if id == mChanOpen {
+		if ch != nil {
+			c.closeConn(504, "CHANNEL_ERROR - second 'channel.open'", id)
+			return
+		}
+		c.channels[channel] = &testChannel{c: c, id: channel, unacked: make(map[uint64]testUnacked)}
+		c.send(method(channel, mChanOpenOk, func(w *argWriter) { w.longstr("") }))
+		return
+	}
+	if ch == nil {
+		c.closeConn(504, "CHANNEL_ERROR - unknown channel", id)
+		return
+	}
+	if ch.closing {
+		// 等待客户端回复 channel.close-ok, 其余方法忽略
+		if id == mChanCloseOk {
+			delete(c.channels, channel)
+		}
+		return
+	}
+
+	switch id {
+	case mChanClose:
+		b.closeChannel(ch)
+		delete(c.channels, channel)
+		c.send(method(channel, mChanCloseOk, nil))
+
+	case mExchDeclare:
+		ar.short()
+		name, kind := ar.shortstr(), ar.shortstr()
+		bits := ar.octet()
+		ar.table()
+		passive, noWait := ar.bit(bits, 0), ar.bit(bits, 4)
+		cur, ok := b.exchanges[name]
+		switch {
+		case !ok && passive:
+			b.channelError(ch, 404, "NOT_FOUND - no exchange '"+name+"'", id)
+			return
+		case ok && !passive && cur != kind:
+			b.channelError(ch, 406, "PRECONDITION_FAILED - inequivalent arg 'type' for exchange '"+name+"'", id)
+			return
+		case !ok:
+			b.exchanges[name] = kind
+		}
+		if !noWait {
+			c.send(method(channel, mExchDeclareOk, nil))
+		}
+
+	case mQueueDeclare:
+		ar.short()
+		name := ar.shortstr()
+		bits := ar.octet()
+		args := ar.table()
+		passive, noWait := ar.bit(bits, 0), ar.bit(bits, 4)
+		if name == "" {
+			b.seq++
+			name = fmt.Sprintf("amq.gen-%d", b.seq)
+		}
+		q, ok := b.queues[name]
+		switch {
+		case !ok && passive:
+			b.channelError(ch, 404, "NOT_FOUND - no queue '"+name+"'", id)
+			return
+		case ok && !passive && !sameTable(q.args, args):
+			b.channelError(ch, 406, "PRECONDITION_FAILED - inequivalent arg for queue '"+name+"'", id)
+			return
+		case !ok:
+			q = &testQueue{name: name, args: args}
+			b.queues[name] = q
+		}
+		if !noWait {
+			c.send(method(channel, mQueueDeclareOk, func(w *argWriter) {
+				w.shortstr(name)
+				w.long(uint32(len(q.msgs)))
+				w.long(uint32(len(q.consumers)))
+			}))
+		}
+
+	case mQueueBind:
+		ar.short()
+		queue, exchange, key := ar.shortstr(), ar.shortstr(), ar.shortstr()
+		noWait := ar.bit(ar.octet(), 0)
+		ar.table()
+		if b.queues[queue] == nil {
+			b.channelError(ch, 404, "NOT_FOUND - no queue '"+queue+"'", id)
+			return
+		}
+		if _, ok := b.exchanges[exchange]; !ok || exchange == "" {
+			b.channelError(ch, 404, "NOT_FOUND - no exchange '"+exchange+"'", id)
+			return
+		}
+		b.bindings[exchange] = append(b.bindings[exchange], testBinding{queue: queue, key: key})
+		if !noWait {
+			c.send(method(channel, mQueueBindOk, nil))
+		}
+
+	case mBasicQos:
+		ar.long()
+		ch.prefetch = int(ar.short())
+		c.send(method(channel, mBasicQosOk, nil))
+
+	case mBasicConsume:
+		ar.short()
+		queue, tag := ar.shortstr(), ar.shortstr()
+		bits := ar.octet()
+		ar.table()
+		noAck, noWait := ar.bit(bits, 1), ar.bit(bits, 3)
+		if tag == "" {
+			b.seq++
+			tag = fmt.Sprintf("amq.ctag-%d", b.seq)
+		}
+		if queue == replyTo {
+			if !noAck {
+				b.channelError(ch, 406, "PRECONDITION_FAILED - reply consumer cannot acknowledge", id)
+				return
+			}
+			b.seq++
+			ch.reply, ch.replyTag = fmt.Sprintf("%d.%s", b.seq, tag), tag
+			b.replies[ch.reply] = ch
+			if !noWait {
+				c.send(method(channel, mBasicConsumeOk, func(w *argWriter) { w.shortstr(tag) }))
+			}
+			return
+		}
+		q := b.queues[queue]
+		if q == nil {
+			b.channelError(ch, 404, "NOT_FOUND - no queue '"+queue+"'", id)
+			return
+		}
+		if !noWait {
+			c.send(method(channel, mBasicConsumeOk, func(w *argWriter) { w.shortstr(tag) }))
+		}
+		q.consumers = append(q.consumers, &testConsumer{ch: ch, queue: queue, tag: tag, noAck: noAck})
+		b.dispatch(q)
+
+	case mBasicCancel:
+		tag := ar.shortstr()
+		noWait := ar.bit(ar.octet(), 0)
+		for _, q := range b.queues {
+			b.removeConsumers(q, func(cs *testConsumer) bool { return cs.ch == ch && cs.tag == tag })
+		}
+		if !noWait {
+			c.send(method(channel, mBasicCancelOk, func(w *argWriter) { w.shortstr(tag) }))
+		}
+
+	case mBasicPublish:
+		ar.short()
+		exchange, key := ar.shortstr(), ar.shortstr()
+		mandatory := ar.bit(ar.octet(), 0)
+		ch.pub = &testMessage{exchange: exchange, key: key}
+		ch.pubMand = mandatory
+		ch.pubReady = false
+
+	case mBasicAck:
+		tag := ar.longlong()
+		multiple := ar.bit(ar.octet(), 0)
+		if !b.settle(ch, tag, multiple, func(testUnacked) {}) {
+			b.channelError(ch, 406, fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag), id)
+		}
+
+	case mBasicNack, mBasicReject:
+		tag := ar.longlong()
+		bits := ar.octet()
+		multiple, requeue := ar.bit(bits, 0), ar.bit(bits, 1)
+		if id == mBasicReject {
+			multiple, requeue = false, ar.bit(bits, 0)
+		}
+		ok := b.settle(ch, tag, multiple, func(u testUnacked) {
+			if requeue {
+				b.requeue(u)
+			}
+		})
+		if !ok {
+			b.channelError(ch, 406, fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag), id)
+		}
+
+	case mConfirmSelect:
+		ch.confirm = true
+		if !ar.bit(ar.octet(), 0) {
+			c.send(method(channel, mConfirmSelectOk, nil))
+		}
+
+	default:
+		c.closeConn(540, "NOT_IMPLEMENTED", id)
+	}
+}
+
+// content 接收 basic.publish 的 header 和 body, 接收完后路由, 调用方持有 b.mu
+func (b *testBroker) content(ch *testChannel, typ byte, payload []byte) {
+	msg := ch.pub
+	if msg == nil {
+		return
+	}
+	if typ == frameHeader {
+		ar := &argReader{b: payload}
+		ar.short()
+		ar.short()
+		ch.pubSize = ar.longlong()
+		msg.props = append([]byte(nil), ar.b...)
+		ch.pubReady = true
+	} else if ch.pubReady {
+		msg.body = append(msg.body, payload...)
+	}
+	if !ch.pubReady || uint64(len(msg.body)) < ch.pubSize {
+		return
+	}
+	ch.pub = nil
+	b.route(ch, msg, ch.pubMand)
+}
+
+// route 把消息投递到匹配的队列, 没有匹配时按 mandatory 退回, confirm 模式下总是 ack
+func (b *testBroker) route(ch *testChannel, msg *testMessage, mandatory bool) {
+	kind, ok := b.exchanges[msg.exchange]
+	if !ok {
+		b.channelError(ch, 404, "NOT_FOUND - no exchange '"+msg.exchange+"'", mBasicPublish)
+		return
+	}
+	if v, start, end := replyToProp(msg.props); v == replyTo && ch.reply != "" {
+		// direct reply-to: 把 reply_to 改写为带 token 的地址
+		props := append([]byte(nil), msg.props[:start]...)
+		w := &argWriter{}
+		w.shortstr(testReplyPrefix + ch.reply)
+		props = append(props, w.Bytes()...)
+		msg.props = append(props, msg.props[end:]...)
+	}
+
+	routed := false
+	if msg.exchange == "" {
+		if strings.HasPrefix(msg.key, testReplyPrefix) {
+			if rc := b.replies[strings.TrimPrefix(msg.key, testReplyPrefix)]; rc != nil {
+				rc.tag++
+				rc.c.send(b.deliver(rc, rc.replyTag, rc.tag, msg)...)
+				routed = true
+			}
+		} else if q := b.queues[msg.key]; q != nil {
+			q.msgs = append(q.msgs, msg)
+			b.dispatch(q)
+			routed = true
+		}
+	} else {
+		for _, bd := range b.bindings[msg.exchange] {
+			q := b.queues[bd.queue]
+			if q == nil || (kind != "fanout" && bd.key != msg.key) {
+				continue
+			}
+			m := *msg
+			q.msgs = append(q.msgs, &m)
+			b.dispatch(q)
+			routed = true
+		}
+	}
+
+	if !routed && mandatory {
+		ch.c.send(method(ch.id, mBasicReturn, func(w *argWriter) {
+			w.short(312)
+			w.shortstr("NO_ROUTE")
+			w.shortstr(msg.exchange)
+			w.shortstr(msg.key)
+		}))
+		ch.c.send(content(ch.id, msg)...)
+	}
+	if ch.confirm {
+		ch.pubSeq++
+		ch.c.send(method(ch.id, mBasicAck, func(w *argWriter) {
+			w.longlong(ch.pubSeq)
+			w.octet(0)
+		}))
+	}
+}
+
+// replyToProp 返回 properties 中的 reply_to 及其在 props 中的位置
+func replyToProp(props []byte) (v string, start, end int) {
+	ar := &argReader{b: props}
+	flags := ar.short()
+	fields := []struct {
+		bit  uint
+		kind byte // s shortstr, t table, o octet, l longlong
+	}{{15, 's'}, {14, 's'}, {13, 't'}, {12, 'o'}, {11, 'o'}, {10, 's'}, {9, 's'}}
+	for _, f := range fields {
+		if flags&(1<<f.bit) == 0 {
+			continue
+		}
+		pos := len(props) - len(ar.b)
+		switch f.kind {
+		case 's':
+			s := ar.shortstr()
+			if f.bit == 9 {
+				return s, pos, len(props) - len(ar.b)
+			}
+		case 't':
+			ar.table()
+		case 'o':
+			ar.octet()
+		}
+		if ar.err != nil {
+			break
+		}
+	}
+	return "", 0, 0
+}
+
+// dispatch 把队列中的消息投递给有空闲的消费者, 调用方持有 b.mu
+func (b *testBroker) dispatch(q *testQueue) {
+	for len(q.msgs) > 0 && len(q.consumers) > 0 {
+		var cs *testConsumer
+		for i := 0; i < len(q.consumers); i++ {
+			c := q.consumers[(q.next+i)%len(q.consumers)]
+			if c.noAck || c.ch.prefetch == 0 || len(c.ch.unacked) < c.ch.prefetch {
+				cs = c
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if cs == nil {
+			return
+		}
+		msg := q.msgs[0]
+		q.msgs = q.msgs[1:]
+		cs.ch.tag++
+		if !cs.noAck {
+			cs.ch.unacked[cs.ch.tag] = testUnacked{queue: q.name, msg: msg}
+		}
+		cs.ch.c.send(b.deliver(cs.ch, cs.tag, cs.ch.tag, msg)...)
+	}
+}
+
+func (b *testBroker) deliver(ch *testChannel, consumerTag string, tag uint64, msg *testMessage) [][]byte {
+	frames := [][]byte{method(ch.id, mBasicDeliver, func(w *argWriter) {
+		w.shortstr(consumerTag)
+		w.longlong(tag)
+		if msg.redelivered {
+			w.octet(1)
+		} else {
+			w.octet(0)
+		}
+		w.shortstr(msg.exchange)
+		w.shortstr(msg.key)
+	})}
+	return append(frames, content(ch.id, msg)...)
+}
+
+// settle 处理 ack/nack, tag 未知时返回 false
+func (b *testBroker) settle(ch *testChannel, tag uint64, multiple bool, fn func(testUnacked)) bool {
+	if multiple {
+		for t, u := range ch.unacked {
+			if t <= tag {
+				delete(ch.unacked, t)
+				fn(u)
+			}
+		}
+	} else {
+		u, ok := ch.unacked[tag]
+		if !ok {
+			return false
+		}
+		delete(ch.unacked, tag)
+		fn(u)
+	}
+	for _, q := range b.queues {
+		b.dispatch(q)
+	}
+	return true
+}
+
+// requeue 消息回到队列头部并标记 redelivered
+func (b *testBroker) requeue(u testUnacked) {
+	q := b.queues[u.queue]
+	if q == nil {
+		return
+	}
+	m := *u.msg
+	m.redelivered = true
+	q.msgs = append([]*testMessage{&m}, q.msgs...)
+}
+
+// channelError 按 AMQP 语义关闭 channel, 客户端收到 *amqp.Error{Server: true}
+func (b *testBroker) channelError(ch *testChannel, code uint16, text string, id uint32) {
+	b.closeChannel(ch)
+	ch.closing = true
+	ch.c.send(method(ch.id, mChanClose, func(w *argWriter) {
+		w.short(code)
+		w.shortstr(text)
+		w.short(uint16(id >> 16))
+		w.short(uint16(id))
+	}))
+}
+
+// closeChannel 移除 channel 上的消费者, 未 ack 的消息重新入队
+func (b *testBroker) closeChannel(ch *testChannel) {
+	for _, q := range b.queues {
+		b.removeConsumers(q, func(cs *testConsumer) bool { return cs.ch == ch })
+	}
+	if ch.reply != "" {
+		delete(b.replies, ch.reply)
+	}
+	for tag, u := range ch.unacked {
+		delete(ch.unacked, tag)
+		b.requeue(u)
+	}
+	for _, q := range b.queues {
+		b.dispatch(q)
+	}
+}
+
+func (b *testBroker) removeConsumers(q *testQueue, match func(*testConsumer) bool) {
+	kept := q.consumers[:0]
+	for _, cs := range q.consumers {
+		if !match(cs) {
+			kept = append(kept, cs)
+		}
+	}
+	q.consumers = kept
+	q.next = 0
+}
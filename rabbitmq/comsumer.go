@@ -1,5 +1,237 @@
 package rabbitmq
 
-func Comsumer() {
-	//TODO
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RabcHandler 消息处理接口, 返回 nil 时 ack, 返回 error 时 nack
+type RabcHandler interface {
+	Handle(d *amqp.Delivery) error
+}
+
+// HandlerFunc 函数形式的 RabcHandler
+type HandlerFunc func(d *amqp.Delivery) error
+
+func (f HandlerFunc) Handle(d *amqp.Delivery) error {
+	return f(d)
+}
+
+// PanicError Handler 发生 panic
+type PanicError struct {
+	Queue string
+	Value interface{} // recover() 的返回值
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("rabbitmq panic queue:%s: %v\n%s", e.Queue, e.Value, e.Stack)
+}
+
+// RabComsumer rabbitmq 消费者, 连接或 channel 断开后自动恢复消费
+type RabComsumer struct {
+	URL       string
+	Conn      *Conn // 不为空时代替 URL, 可以和其他消费者/生产者共用
+	Queue     string
+	QueueArgs amqp.Table // 队列参数, 如 x-dead-letter-exchange
+
+	Exchanges []Exchange // 绑定前先声明的交换机
+	Bindings  []Binding
+
+	Handler RabcHandler
+
+	// Concurrency 同时处理的消息数, 默认 1
+	Concurrency int
+	// Prefetch 未 ack 消息的上限, 默认等于 Concurrency
+	Prefetch int
+	// NoRequeue 为 true 时处理失败的消息 nack 后不重新入队, 队列配置了死信交换机时进入死信
+	NoRequeue bool
+	// Retry 不为空时处理失败的消息不再 nack, 而是写入延迟重试队列后 ack, 见 RetryPolicy
+	Retry *RetryPolicy
+
+	// OnError 处理失败回调, 为空时打印错误
+	OnError func(d *amqp.Delivery, err error)
+
+	// Tag 消费者标识, 为空时由 broker 生成
+	Tag string
+
+	retryp *RabProducer
+}
+
+// Comsumer rabbitmq 消费, 等同于 Run(context.Background())
+func (c *RabComsumer) Comsumer() error {
+	return c.Run(context.Background())
+}
+
+// Run 连接并消费, ctx 取消后停止接收, 等待处理中的消息完成后返回 nil;
+// 已投递未处理的消息 nack 重新入队. 连接或 channel 断开、broker 取消消费者(如队列被删除)后重新声明队列继续消费,
+// 首次连接失败、Conn 被关闭或者 broker 拒绝声明/消费(如队列参数不一致的 PRECONDITION_FAILED)时返回 error
+func (c *RabComsumer) Run(ctx context.Context) error {
+	if c.Handler == nil {
+		return errors.New("rabbitmq Handler is nil")
+	}
+	conn := c.Conn
+	if conn == nil {
+		conn = &Conn{URL: c.URL}
+		defer conn.Close()
+	}
+	if err := conn.Connect(); err != nil {
+		return err
+	}
+	if c.Retry != nil {
+		c.retryp = &RabProducer{Conn: conn}
+		defer c.retryp.Close()
+	}
+
+	for {
+		ch, err := conn.Channel(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		err = c.consume(ctx, ch)
+		ch.Close()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if refused(err) {
+			return err
+		}
+
+		fmt.Printf("[WARN] rabbitmq comsumer queue:%s resume after: %v\n", c.Queue, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// consume 声明拓扑后在 ch 上消费, 直到 ctx 取消、ch 关闭或者 broker 取消消费者
+func (c *RabComsumer) consume(ctx context.Context, ch *amqp.Channel) error {
+	for _, e := range c.Exchanges {
+		if err := e.declare(ch); err != nil {
+			return err
+		}
+	}
+	if err := declareQueue(ch, c.Queue, c.QueueArgs, c.Bindings); err != nil {
+		return err
+	}
+	if c.Retry != nil {
+		if err := c.Retry.declare(ch, c.Queue); err != nil {
+			return err
+		}
+	}
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	prefetch := c.Prefetch
+	if prefetch <= 0 {
+		prefetch = concurrency
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return err
+	}
+
+	tag := c.Tag
+	if tag == "" {
+		tag = fmt.Sprintf("rabcomsumer-%p", c)
+	}
+	deliveries, err := ch.Consume(c.Queue, tag, false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	// 队列被删除或者镜像/仲裁队列切换主节点时 broker 发送 basic.cancel, deliveries 关闭但 channel 仍然打开
+	cancelled := ch.NotifyCancel(make(chan string, 1))
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range deliveries {
+				// Handler 可能保留 *amqp.Delivery, 每条消息使用单独的变量
+				d := d
+				if ctx.Err() != nil {
+					d.Nack(false, true)
+					continue
+				}
+				c.process(&d)
+			}
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		// Cancel 后 broker 不再投递, deliveries 在已投递的消息读完后关闭
+		if e := ch.Cancel(tag, false); e != nil {
+			err = e
+		}
+	case e := <-closed:
+		if e != nil {
+			err = e
+		} else {
+			err = amqp.ErrClosed
+		}
+	case <-cancelled:
+		err = fmt.Errorf("rabbitmq comsumer queue:%s cancelled by broker", c.Queue)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// process 调用 Handler, 成功 ack, 失败或 panic 时写入重试队列后 ack, 没有 Retry 时 nack
+func (c *RabComsumer) process(d *amqp.Delivery) {
+	if err := c.handle(d); err != nil {
+		if c.OnError != nil {
+			c.OnError(d, err)
+		} else {
+			fmt.Printf("[ERROR] rabbitmq queue:%s attempts:%d %s\n", c.Queue, attempts(d)+1, err.Error())
+		}
+		requeue := !c.NoRequeue
+		if c.Retry != nil {
+			rerr := c.Retry.retry(context.Background(), c.retryp, c.Queue, d, err)
+			if rerr == nil {
+				c.ack(d)
+				return
+			}
+			// 写入重试队列失败, 重新入队稍后再处理
+			fmt.Printf("[ERROR] %s\n", rerr.Error())
+			requeue = true
+		}
+		if err := d.Nack(false, requeue); err != nil {
+			fmt.Printf("[ERROR] rabbitmq nack queue:%s %s\n", c.Queue, err.Error())
+		}
+		return
+	}
+	c.ack(d)
+}
+
+func (c *RabComsumer) ack(d *amqp.Delivery) {
+	if err := d.Ack(false); err != nil {
+		fmt.Printf("[ERROR] rabbitmq ack queue:%s %s\n", c.Queue, err.Error())
+	}
+}
+
+func (c *RabComsumer) handle(d *amqp.Delivery) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Queue: c.Queue, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return c.Handler.Handle(d)
 }
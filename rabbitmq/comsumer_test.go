@@ -0,0 +1,194 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRabComsumer_Run(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var handled []string
+	c := &RabComsumer{
+		URL:         b.URL(),
+		Queue:       "orders",
+		Concurrency: 2,
+		Handler: HandlerFunc(func(d *amqp.Delivery) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if string(d.Body) == "b" && !d.Redelivered {
+				handled = append(handled, "b failed")
+				return errors.New("bad message")
+			}
+			handled = append(handled, string(d.Body))
+			if len(handled) == 4 {
+				cancel()
+			}
+			return nil
+		}),
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	waitFor(t, "consumer", func() bool { return b.Consumers("orders") == 1 })
+	for _, v := range []string{"a", "b", "c"} {
+		b.Publish("orders", v)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 4 {
+		t.Fatalf("handled %v, want failed b redelivered", handled)
+	}
+	if ready := b.Ready("orders"); len(ready) != 0 {
+		t.Fatalf("messages left %v", ready)
+	}
+}
+
+func TestRabComsumer_Shutdown(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	c := &RabComsumer{
+		URL:      b.URL(),
+		Queue:    "orders",
+		Prefetch: 2,
+		Handler: HandlerFunc(func(d *amqp.Delivery) error {
+			close(handling)
+			<-release
+			return nil
+		}),
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	waitFor(t, "consumer", func() bool { return b.Consumers("orders") == 1 })
+	b.Publish("orders", "a")
+	b.Publish("orders", "b")
+	<-handling
+
+	// 处理中的消息完成后 ack, 已投递未处理的消息重新入队
+	cancel()
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "requeue", func() bool { return len(b.Ready("orders")) == 1 })
+	if ready := b.Ready("orders"); ready[0] != "b" {
+		t.Fatalf("messages left %v, want [b]", ready)
+	}
+}
+
+func TestRabComsumer_Reconnect(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	handled := make(chan string, 2)
+	c := &RabComsumer{
+		Conn:  &Conn{URL: b.URL(), ReconnectBackoff: 10 * time.Millisecond},
+		Queue: "orders",
+		Handler: HandlerFunc(func(d *amqp.Delivery) error {
+			handled <- string(d.Body)
+			return nil
+		}),
+	}
+	defer c.Conn.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	waitFor(t, "consumer", func() bool { return b.Consumers("orders") == 1 })
+	b.Publish("orders", "a")
+	<-handled
+
+	// 连接断开后重新声明队列继续消费
+	b.Drop()
+	b.DeleteQueue("orders")
+	waitFor(t, "consumer after reconnect", func() bool { return b.Consumers("orders") == 1 })
+	b.Publish("orders", "b")
+	if v := <-handled; v != "b" {
+		t.Fatalf("handled %s after reconnect, want b", v)
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRabComsumer_Cancelled(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	handled := make(chan string, 2)
+	c := &RabComsumer{
+		URL:   b.URL(),
+		Queue: "orders",
+		Handler: HandlerFunc(func(d *amqp.Delivery) error {
+			handled <- string(d.Body)
+			return nil
+		}),
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+
+	waitFor(t, "consumer", func() bool { return b.Consumers("orders") == 1 })
+	b.Publish("orders", "a")
+	<-handled
+
+	// 连接不断开, broker 删除队列后发送 basic.cancel
+	b.DeleteQueue("orders")
+	waitFor(t, "consumer after cancel", func() bool { return b.Consumers("orders") == 1 })
+	b.Publish("orders", "b")
+	if v := <-handled; v != "b" {
+		t.Fatalf("handled %s after cancel, want b", v)
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRabComsumer_Refused(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	// 已存在的队列带 x-max-length, 不带参数的声明被 broker 以 PRECONDITION_FAILED 拒绝
+	w := &argWriter{}
+	w.shortstr("x-max-length")
+	w.octet('l')
+	w.longlong(10)
+	args := &argWriter{}
+	args.longstr(w.String())
+	b.DeclareQueue("orders", args.Bytes())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &RabComsumer{
+		URL:     b.URL(),
+		Queue:   "orders",
+		Handler: HandlerFunc(func(d *amqp.Delivery) error { return nil }),
+	}
+	err := c.Run(ctx)
+	if e, ok := err.(*amqp.Error); !ok || e.Code != amqp.PreconditionFailed {
+		t.Fatalf("run: %v, want PRECONDITION_FAILED", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("run retried until ctx timeout")
+	}
+}
@@ -0,0 +1,309 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrConnClosed Conn 已关闭
+var ErrConnClosed = errors.New("rabbitmq conn closed")
+
+// State 连接状态
+type State int
+
+const (
+	StateConnecting State = iota
+	StateConnected
+	StateDisconnected
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Queue 队列及其绑定, 总是 durable
+type Queue struct {
+	Name     string
+	Args     amqp.Table
+	Bindings []Binding
+}
+
+// Conn 自动重连的 rabbitmq 连接, 并发安全
+// 连接断开后按 ReconnectBackoff 翻倍重连, 每次连接成功后重新声明 Exchanges 和 Queues
+type Conn struct {
+	URL string
+
+	Exchanges []Exchange
+	Queues    []Queue
+
+	// ReconnectBackoff 首次重连间隔, 默认 1s, 之后每次翻倍, 最大 MaxReconnectBackoff(默认 30s)
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+
+	// OnStateChange 连接状态变化时回调, err 为断开或重连失败的原因
+	OnStateChange func(state State, err error)
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	started bool
+	done    chan struct{}
+	changed chan struct{} // 连接变化时关闭并替换
+}
+
+// Connect 建立连接并开始监听断开, 首次连接失败时返回 error; 已连接时直接返回
+func (c *Conn) Connect() error {
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.done == nil {
+		c.done = make(chan struct{})
+		c.changed = make(chan struct{})
+	}
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return ErrConnClosed
+	default:
+	}
+	c.mu.Unlock()
+
+	c.notify(StateConnecting, nil)
+	conn, err := c.dial()
+	if err != nil {
+		c.notify(StateDisconnected, err)
+		return err
+	}
+
+	c.mu.Lock()
+	if c.started {
+		// 并发调用 Connect, 已由其他调用者完成
+		c.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	c.started = true
+	c.set(conn)
+	c.mu.Unlock()
+
+	c.notify(StateConnected, nil)
+	go c.watch(conn)
+	return nil
+}
+
+// Channel 返回当前连接上新建的 channel, 正在重连时等待重连成功或 ctx 取消
+func (c *Conn) Channel(ctx context.Context) (*amqp.Channel, error) {
+	for {
+		conn, err := c.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ch, err := conn.Channel()
+		if err == nil {
+			return ch, nil
+		}
+		if !conn.IsClosed() {
+			return nil, err
+		}
+		// 连接刚好断开, 等待重连
+	}
+}
+
+// Close 关闭连接, 之后不再重连
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+		c.changed = make(chan struct{})
+	}
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return nil
+	default:
+	}
+	close(c.done)
+	conn := c.conn
+	c.set(nil)
+	c.mu.Unlock()
+
+	c.notify(StateClosed, nil)
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// connection 返回可用的连接, 未连接时先 Connect
+func (c *Conn) connection(ctx context.Context) (*amqp.Connection, error) {
+	if err := c.Connect(); err != nil {
+		return nil, err
+	}
+	for {
+		c.mu.Lock()
+		conn, changed, done := c.conn, c.changed, c.done
+		c.mu.Unlock()
+
+		if conn != nil && !conn.IsClosed() {
+			return conn, nil
+		}
+		select {
+		case <-changed:
+		case <-done:
+			return nil, ErrConnClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// watch 等待连接断开后重连, 直到 Close
+func (c *Conn) watch(conn *amqp.Connection) {
+	for {
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		var cause error
+		select {
+		case <-c.done:
+			return
+		case err := <-closed:
+			if err != nil {
+				cause = err
+			} else {
+				cause = amqp.ErrClosed
+			}
+		}
+
+		c.mu.Lock()
+		select {
+		case <-c.done:
+			// Close 主动关闭
+			c.mu.Unlock()
+			return
+		default:
+		}
+		c.set(nil)
+		c.mu.Unlock()
+		c.notify(StateDisconnected, cause)
+
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+// reconnect 按退避间隔重连, Close 后返回 nil
+func (c *Conn) reconnect() *amqp.Connection {
+	backoff := c.ReconnectBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := c.MaxReconnectBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	for attempt, wait := 1, backoff; ; attempt++ {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(wait):
+		}
+
+		c.notify(StateConnecting, nil)
+		conn, err := c.dial()
+		if err != nil {
+			fmt.Printf("[WARN] rabbitmq reconnect %d failed: %s\n", attempt, err.Error())
+			c.notify(StateDisconnected, err)
+			if wait *= 2; wait > maxBackoff {
+				wait = maxBackoff
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		select {
+		case <-c.done:
+			c.mu.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		c.set(conn)
+		c.mu.Unlock()
+		c.notify(StateConnected, nil)
+		return conn
+	}
+}
+
+// dial 连接并声明拓扑
+func (c *Conn) dial() (*amqp.Connection, error) {
+	conn, err := amqp.Dial(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.declare(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *Conn) declare(conn *amqp.Connection) error {
+	if len(c.Exchanges) == 0 && len(c.Queues) == 0 {
+		return nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, e := range c.Exchanges {
+		if err := e.declare(ch); err != nil {
+			return fmt.Errorf("rabbitmq declare exchange:%s %v", e.Name, err)
+		}
+	}
+	for _, q := range c.Queues {
+		if err := declareQueue(ch, q.Name, q.Args, q.Bindings); err != nil {
+			return fmt.Errorf("rabbitmq declare queue:%s %v", q.Name, err)
+		}
+	}
+	return nil
+}
+
+// set 替换当前连接并唤醒等待者, 调用方需持有 c.mu
+func (c *Conn) set(conn *amqp.Connection) {
+	c.conn = conn
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// refused broker 以 channel 级错误拒绝了操作(如 PRECONDITION_FAILED / NOT_FOUND / ACCESS_REFUSED),
+// 是配置问题, 重连后重试也不会成功; 连接级错误和网络错误返回 false
+func refused(err error) bool {
+	e, ok := err.(*amqp.Error)
+	return ok && e.Server && e.Recover
+}
+
+func (c *Conn) notify(state State, err error) {
+	if c.OnStateChange != nil {
+		c.OnStateChange(state, err)
+	}
+}
@@ -0,0 +1,62 @@
+package rabbitmq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConn_Reconnect(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	var mu sync.Mutex
+	var states []State
+	c := &Conn{
+		URL:              b.URL(),
+		Queues:           []Queue{{Name: "orders"}},
+		ReconnectBackoff: 10 * time.Millisecond,
+		OnStateChange: func(state State, err error) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		},
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Consumers("orders") != 0 {
+		t.Fatal("queue not declared")
+	}
+
+	// 断开后重连并重新声明队列
+	b.DeleteQueue("orders")
+	b.Drop()
+	waitFor(t, "redeclare", func() bool { return b.Consumers("orders") == 0 })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ch, err := c.Channel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Channel(ctx); err != ErrConnClosed {
+		t.Fatalf("channel after close: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []State{StateConnecting, StateConnected, StateDisconnected, StateConnecting, StateConnected, StateClosed}
+	if len(states) != len(want) {
+		t.Fatalf("states %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states %v, want %v", states, want)
+		}
+	}
+}
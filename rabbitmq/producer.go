@@ -1,5 +1,282 @@
 package rabbitmq
 
-func Publish() {
-	//TODO
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/wthsjy/hswjywtgu2/pool"
+)
+
+// ErrProducerClosed 生产者已关闭
+var ErrProducerClosed = errors.New("rabbitmq producer closed")
+
+// ErrNack broker 拒绝了消息(basic.nack)
+var ErrNack = errors.New("rabbitmq publish nacked")
+
+// ReturnError Mandatory 消息没有可投递的队列, 被 broker 退回
+type ReturnError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnError) Error() string {
+	return fmt.Sprintf("rabbitmq message returned exchange:%s routing_key:%s code:%d %s",
+		e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// Message rabbitmq 生产消息
+type Message struct {
+	Exchange    string
+	RoutingKey  string
+	Body        []byte
+	Headers     amqp.Table
+	ContentType string
+
+	Transient bool          // 为 true 时不持久化, 默认持久化
+	TTL       time.Duration // 消息过期时间, 0 表示不过期
+	Mandatory bool          // 为 true 时没有匹配队列的消息会被退回, Publish 返回 *ReturnError
+
+	MessageId     string
+	CorrelationId string
+	ReplyTo       string
+}
+
+func (m *Message) publishing() amqp.Publishing {
+	p := amqp.Publishing{
+		Headers:       m.Headers,
+		ContentType:   m.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		MessageId:     m.MessageId,
+		CorrelationId: m.CorrelationId,
+		ReplyTo:       m.ReplyTo,
+		Timestamp:     time.Now(),
+		Body:          m.Body,
+	}
+	if m.Transient {
+		p.DeliveryMode = amqp.Transient
+	}
+	if m.TTL > 0 {
+		p.Expiration = strconv.FormatInt(int64(m.TTL/time.Millisecond), 10)
+	}
+	return p
+}
+
+// RabProducer rabbitmq 生产者, 共用一个连接, 通过 channel 池并发发送, 每条消息都等待 publisher confirm
+type RabProducer struct {
+	URL  string
+	Conn *Conn // 不为空时代替 URL, 连接断开后 channel 池会在新连接上重建
+
+	// Exchanges 每次连接成功后声明(或 Passive 校验)的交换机
+	Exchanges []Exchange
+
+	// Channels channel 池大小, 也是同时发送的消息数上限, 默认 8
+	Channels int
+	// ConfirmTimeout 等待 confirm 的最长时间, 默认 5s, ctx 的 deadline 更早时以 ctx 为准
+	ConfirmTimeout time.Duration
+
+	// OnReturn Mandatory 消息被退回时回调, 可为空
+	OnReturn func(r amqp.Return)
+
+	mu      sync.Mutex
+	closed  bool
+	rc      *Conn
+	ownConn bool
+	conn    *amqp.Connection // 已声明过 Exchanges 的连接
+	pool    *pool.ClientPool
+}
+
+// confirmChannel confirm 模式的 channel, 同一时间只发送一条消息, 因此收到的 confirm 就是该消息的
+type confirmChannel struct {
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	closed   chan *amqp.Error
+}
+
+// Publish 发送消息并等待 broker confirm
+func (p *RabProducer) Publish(ctx context.Context, msg *Message) error {
+	pc, err := p.channel()
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	cc := pc.RawClient().(*confirmChannel)
+
+	if err := cc.ch.Publish(msg.Exchange, msg.RoutingKey, msg.Mandatory, false, msg.publishing()); err != nil {
+		pc.MarkUnusable()
+		return err
+	}
+
+	reusable, err := p.confirm(ctx, cc, msg)
+	if !reusable {
+		pc.MarkUnusable()
+	}
+	return err
+}
+
+// confirm 等待刚发送的 msg 的 confirm, reusable 为 false 时 channel 不能再放回池中
+func (p *RabProducer) confirm(ctx context.Context, cc *confirmChannel, msg *Message) (reusable bool, err error) {
+	timer := time.NewTimer(p.confirmTimeout())
+	defer timer.Stop()
+
+	select {
+	case c, ok := <-cc.confirms:
+		if !ok {
+			return false, amqp.ErrClosed
+		}
+		// 退回的消息 broker 会先发 basic.return 再发 basic.ack, amqp 按顺序分发,
+		// 收到 confirm 时 return 已经在 returns 中; 必须在这里取走, 否则会被算到下一条消息上
+		select {
+		case r := <-cc.returns:
+			if p.OnReturn != nil {
+				p.OnReturn(r)
+			}
+			err = &ReturnError{Exchange: r.Exchange, RoutingKey: r.RoutingKey, ReplyCode: r.ReplyCode, ReplyText: r.ReplyText}
+		default:
+		}
+		if !c.Ack {
+			return true, ErrNack
+		}
+		return true, err
+	case <-timer.C:
+		// confirm 可能稍后到达, 这个 channel 不能再复用
+		return false, fmt.Errorf("rabbitmq publish exchange:%s routing_key:%s confirm timeout", msg.Exchange, msg.RoutingKey)
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// Close 关闭 channel 池和连接
+func (p *RabProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.pool != nil {
+		p.pool.Release()
+	}
+	if p.ownConn {
+		return p.rc.Close()
+	}
+	return nil
+}
+
+func (p *RabProducer) confirmTimeout() time.Duration {
+	if p.ConfirmTimeout > 0 {
+		return p.ConfirmTimeout
+	}
+	return 5 * time.Second
+}
+
+func (p *RabProducer) channel() (pool.PooledClient, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrProducerClosed
+	}
+	if p.pool == nil {
+		size := p.Channels
+		if size <= 0 {
+			size = 8
+		}
+		p.pool = &pool.ClientPool{
+			Dial:         p.dial,
+			Close:        func(c interface{}) error { return c.(*confirmChannel).ch.Close() },
+			TestOnBorrow: func(c interface{}, t time.Time) error { return c.(*confirmChannel).err() },
+			MaxIdle:      size,
+			MaxActive:    size,
+			Wait:         true,
+		}
+	}
+	cp := p.pool
+	p.mu.Unlock()
+	return cp.Get()
+}
+
+// dial 在共用连接上创建 confirm channel
+func (p *RabProducer) dial() (interface{}, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return &confirmChannel{
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 1)),
+		closed:   ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}, nil
+}
+
+// connect 返回当前连接, 正在重连时最多等待 ConfirmTimeout; 每个新连接上声明一次 Exchanges
+func (p *RabProducer) connect() (*amqp.Connection, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrProducerClosed
+	}
+	if p.rc == nil {
+		p.rc = p.Conn
+		if p.rc == nil {
+			p.rc, p.ownConn = &Conn{URL: p.URL}, true
+		}
+	}
+	rc := p.rc
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.confirmTimeout())
+	defer cancel()
+	conn, err := rc.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn == p.conn || len(p.Exchanges) == 0 {
+		p.conn = conn
+		return conn, nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+	for _, e := range p.Exchanges {
+		if err := e.declare(ch); err != nil {
+			return nil, fmt.Errorf("rabbitmq declare exchange:%s %v", e.Name, err)
+		}
+	}
+	p.conn = conn
+	return conn, nil
+}
+
+// err channel 已关闭时返回关闭原因
+func (c *confirmChannel) err() error {
+	select {
+	case err, ok := <-c.closed:
+		if ok && err != nil {
+			return err
+		}
+		return amqp.ErrClosed
+	default:
+		return nil
+	}
 }
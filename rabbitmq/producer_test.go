@@ -0,0 +1,74 @@
+package rabbitmq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestMessage_publishing(t *testing.T) {
+	p := (&Message{Body: []byte("hello"), TTL: 1500 * time.Millisecond}).publishing()
+	if p.DeliveryMode != amqp.Persistent || p.Expiration != "1500" {
+		t.Fatalf("publishing mode:%d expiration:%q", p.DeliveryMode, p.Expiration)
+	}
+	p = (&Message{Transient: true}).publishing()
+	if p.DeliveryMode != amqp.Transient || p.Expiration != "" {
+		t.Fatalf("transient publishing mode:%d expiration:%q", p.DeliveryMode, p.Expiration)
+	}
+}
+
+func TestRabProducer_Publish(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+	b.DeclareQueue("orders", nil)
+
+	var returned int
+	p := &RabProducer{URL: b.URL(), Channels: 1, OnReturn: func(amqp.Return) { returned++ }}
+	defer p.Close()
+	ctx := context.Background()
+
+	// 同一个 channel 上连续退回, 每次都要返回 *ReturnError, 不能影响下一条消息
+	for i := 0; i < 20; i++ {
+		err := p.Publish(ctx, &Message{RoutingKey: "missing", Body: []byte("x"), Mandatory: true})
+		if _, ok := err.(*ReturnError); !ok {
+			t.Fatalf("publish %d to missing queue: %v, want *ReturnError", i, err)
+		}
+		if err := p.Publish(ctx, &Message{RoutingKey: "orders", Body: []byte("a"), Mandatory: true}); err != nil {
+			t.Fatalf("publish %d to orders: %v", i, err)
+		}
+	}
+	if returned != 20 {
+		t.Fatalf("OnReturn called %d times, want 20", returned)
+	}
+	if err := p.Publish(ctx, &Message{RoutingKey: "missing", Body: []byte("x")}); err != nil {
+		t.Fatalf("publish without mandatory: %v", err)
+	}
+	if ready := b.Ready("orders"); len(ready) != 20 {
+		t.Fatalf("orders has %d messages, want 20", len(ready))
+	}
+}
+
+func TestRabProducer_confirm(t *testing.T) {
+	p := &RabProducer{}
+	cc := &confirmChannel{confirms: make(chan amqp.Confirmation, 1), returns: make(chan amqp.Return, 1)}
+	msg := &Message{RoutingKey: "missing", Mandatory: true}
+
+	// return 和 confirm 同时就绪时也不能漏掉 return
+	for i := 0; i < 20; i++ {
+		cc.returns <- amqp.Return{RoutingKey: "missing", ReplyCode: 312, ReplyText: "NO_ROUTE"}
+		cc.confirms <- amqp.Confirmation{DeliveryTag: uint64(i + 1), Ack: true}
+		reusable, err := p.confirm(context.Background(), cc, msg)
+		if _, ok := err.(*ReturnError); !ok || !reusable {
+			t.Fatalf("confirm %d: %v reusable:%v, want *ReturnError", i, err, reusable)
+		}
+		if len(cc.returns) != 0 {
+			t.Fatalf("confirm %d left a stale return", i)
+		}
+	}
+	cc.confirms <- amqp.Confirmation{Ack: false}
+	if _, err := p.confirm(context.Background(), cc, msg); err != ErrNack {
+		t.Fatalf("nack: %v", err)
+	}
+}
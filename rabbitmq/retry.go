@@ -0,0 +1,104 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// 重试消息携带的 header
+const (
+	HeaderRetryAttempts = "x-retry-attempts"
+	HeaderRetryError    = "x-retry-error"
+)
+
+// RetryPolicy 延迟重试: 第 n 次失败的消息写入 TTL 为 Delays[n-1] 的重试队列,
+// 过期后经默认交换机死信回到工作队列; 失败次数超过 len(Delays) 后写入停车队列
+//
+//	queue.retry.1s -> queue, queue.retry.10s -> queue, queue.retry.1m0s -> queue, queue.parking
+type RetryPolicy struct {
+	Delays       []time.Duration // 默认 1s, 10s, 1m
+	ParkingQueue string          // 默认 Queue + ".parking"
+}
+
+var defaultRetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+func (r *RetryPolicy) delays() []time.Duration {
+	if len(r.Delays) > 0 {
+		return r.Delays
+	}
+	return defaultRetryDelays
+}
+
+// retryQueue 队列名带上延迟, 修改 Delays 后会使用新的队列, 避免和已存在队列的参数冲突
+func retryQueue(queue string, delay time.Duration) string {
+	return queue + ".retry." + delay.String()
+}
+
+func (r *RetryPolicy) parkingQueue(queue string) string {
+	if r.ParkingQueue != "" {
+		return r.ParkingQueue
+	}
+	return queue + ".parking"
+}
+
+// declare 声明重试队列和停车队列
+func (r *RetryPolicy) declare(ch *amqp.Channel, queue string) error {
+	for _, delay := range r.delays() {
+		args := amqp.Table{
+			"x-message-ttl":             int64(delay / time.Millisecond),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		}
+		if err := declareQueue(ch, retryQueue(queue, delay), args, nil); err != nil {
+			return err
+		}
+	}
+	return declareQueue(ch, r.parkingQueue(queue), nil, nil)
+}
+
+// attempts 返回消息已经失败的次数
+func attempts(d *amqp.Delivery) int {
+	switch n := d.Headers[HeaderRetryAttempts].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+// retry 把失败的消息写入下一个重试队列或停车队列, 写入成功后调用方 ack 原消息
+func (r *RetryPolicy) retry(ctx context.Context, p *RabProducer, queue string, d *amqp.Delivery, cause error) error {
+	n := attempts(d) + 1
+	target := r.parkingQueue(queue)
+	if delays := r.delays(); n <= len(delays) {
+		target = retryQueue(queue, delays[n-1])
+	}
+
+	headers := make(amqp.Table, len(d.Headers)+2)
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[HeaderRetryAttempts] = int32(n)
+	headers[HeaderRetryError] = cause.Error()
+
+	err := p.Publish(ctx, &Message{
+		RoutingKey:    target,
+		Body:          d.Body,
+		Headers:       headers,
+		ContentType:   d.ContentType,
+		MessageId:     d.MessageId,
+		CorrelationId: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		Mandatory:     true,
+	})
+	if err != nil {
+		return fmt.Errorf("rabbitmq retry queue:%s %v", target, err)
+	}
+	return nil
+}
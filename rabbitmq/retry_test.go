@@ -0,0 +1,80 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRetryPolicy_queues(t *testing.T) {
+	r := &RetryPolicy{}
+	if got := retryQueue("orders", r.delays()[1]); got != "orders.retry.10s" {
+		t.Fatalf("retry queue %s", got)
+	}
+	if got := r.parkingQueue("orders"); got != "orders.parking" {
+		t.Fatalf("parking queue %s", got)
+	}
+
+	d := &amqp.Delivery{}
+	if attempts(d) != 0 {
+		t.Fatalf("attempts %d, want 0", attempts(d))
+	}
+	d.Headers = amqp.Table{HeaderRetryAttempts: int32(2)}
+	if attempts(d) != 2 {
+		t.Fatalf("attempts %d, want 2", attempts(d))
+	}
+	if len((&RetryPolicy{Delays: []time.Duration{time.Second}}).delays()) != 1 {
+		t.Fatal("custom delays ignored")
+	}
+}
+
+func TestRabComsumer_Retry(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	handled := make(chan *amqp.Delivery, 4)
+	c := &RabComsumer{
+		URL:   b.URL(),
+		Queue: "orders",
+		Retry: &RetryPolicy{Delays: []time.Duration{time.Second}},
+		Handler: HandlerFunc(func(d *amqp.Delivery) error {
+			handled <- d
+			if d.Redelivered {
+				return nil
+			}
+			return errors.New("bad message")
+		}),
+		OnError: func(d *amqp.Delivery, err error) {},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Run(ctx) }()
+	waitFor(t, "consumer", func() bool { return b.Consumers("orders") == 1 })
+
+	// 写入重试队列成功后 ack 原消息
+	b.Publish("orders", "a")
+	<-handled
+	waitFor(t, "retry queue", func() bool { return len(b.Ready("orders.retry.1s")) == 1 })
+
+	// 重试队列不存在时 mandatory 消息被退回, 原消息必须 nack 重新入队而不是 ack 丢失
+	b.DeleteQueue("orders.retry.1s")
+	b.Publish("orders", "b")
+	if d := <-handled; d.Redelivered {
+		t.Fatal("first delivery redelivered")
+	}
+	if d := <-handled; string(d.Body) != "b" || !d.Redelivered {
+		t.Fatalf("handled %s redelivered:%v, want b redelivered", d.Body, d.Redelivered)
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if ready := b.Ready("orders"); len(ready) != 0 {
+		t.Fatalf("messages left %v", ready)
+	}
+}
@@ -0,0 +1,295 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// replyTo rabbitmq direct reply-to 伪队列, 不需要声明回复队列
+const replyTo = "amq.rabbitmq.reply-to"
+
+// HeaderRPCError RPCServer 处理失败时在回复中携带的错误信息
+const HeaderRPCError = "x-rpc-error"
+
+// RPCError 服务端 Handler 返回的错误
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "rabbitmq rpc: " + e.Message
+}
+
+// RPCClient 基于 direct reply-to 的 rpc 客户端, 并发安全
+type RPCClient struct {
+	URL      string
+	Conn     *Conn  // 不为空时代替 URL
+	Exchange string // 请求发送到的交换机, 默认为默认交换机, 此时 routing key 为服务端队列名
+
+	// Timeout ctx 没有 deadline 时的超时时间, 默认 5s; 请求消息的 TTL 与超时一致, 过期后服务端不再处理
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	closed  bool
+	rc      *Conn
+	ownConn bool
+	ch      *amqp.Channel
+	pending map[string]chan rpcReply
+	seq     uint64
+}
+
+// rpcReply 回复或者被退回的请求
+type rpcReply struct {
+	d        amqp.Delivery
+	returned *amqp.Return
+}
+
+// Call 发送请求并等待回复, 没有服务端队列时返回 *ReturnError, 服务端处理失败时返回 *RPCError
+func (c *RPCClient) Call(ctx context.Context, routingKey string, body []byte) ([]byte, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ch, err := c.channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// 已经超时的请求不再发送, 否则没有过期时间, 服务端会处理没有人等待的请求
+	deadline, _ := ctx.Deadline()
+	if timeout = time.Until(deadline); timeout <= 0 || ctx.Err() != nil {
+		return nil, fmt.Errorf("rabbitmq rpc routing_key:%s %v", routingKey, context.DeadlineExceeded)
+	}
+	id := strconv.FormatUint(atomic.AddUint64(&c.seq, 1), 36) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	reply := make(chan rpcReply, 1)
+	c.mu.Lock()
+	c.pending[id] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	msg := &Message{
+		Exchange:      c.Exchange,
+		RoutingKey:    routingKey,
+		Body:          body,
+		Transient:     true,
+		TTL:           timeout,
+		Mandatory:     true,
+		CorrelationId: id,
+		ReplyTo:       replyTo,
+	}
+	if err := ch.Publish(msg.Exchange, msg.RoutingKey, msg.Mandatory, false, msg.publishing()); err != nil {
+		return nil, err
+	}
+
+	select {
+	case r, ok := <-reply:
+		if !ok {
+			return nil, amqp.ErrClosed
+		}
+		if ret := r.returned; ret != nil {
+			return nil, &ReturnError{Exchange: ret.Exchange, RoutingKey: ret.RoutingKey, ReplyCode: ret.ReplyCode, ReplyText: ret.ReplyText}
+		}
+		if e, ok := r.d.Headers[HeaderRPCError]; ok {
+			return nil, &RPCError{Message: fmt.Sprint(e)}
+		}
+		return r.d.Body, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("rabbitmq rpc routing_key:%s %v", routingKey, ctx.Err())
+	}
+}
+
+// Close 关闭 channel, 等待中的 Call 返回 amqp.ErrClosed
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.ch != nil {
+		c.ch.Close()
+	}
+	if c.ownConn {
+		return c.rc.Close()
+	}
+	return nil
+}
+
+// channel 返回用于发送请求和接收回复的 channel, 断开后重新创建
+func (c *RPCClient) channel(ctx context.Context) (*amqp.Channel, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrConnClosed
+	}
+	if c.ch != nil {
+		ch := c.ch
+		c.mu.Unlock()
+		return ch, nil
+	}
+	if c.rc == nil {
+		c.rc = c.Conn
+		if c.rc == nil {
+			c.rc, c.ownConn = &Conn{URL: c.URL}, true
+		}
+		c.pending = make(map[string]chan rpcReply)
+	}
+	rc := c.rc
+	c.mu.Unlock()
+
+	ch, err := rc.Channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// direct reply-to 必须 autoAck, 且必须在同一个 channel 上发送请求
+	replies, err := ch.Consume(replyTo, "", true, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.ch != nil {
+		// 已关闭或者并发创建了其他 channel
+		ch.Close()
+		if c.closed {
+			return nil, ErrConnClosed
+		}
+		return c.ch, nil
+	}
+	c.ch = ch
+	go c.dispatch(ch, replies, returns)
+	return ch, nil
+}
+
+// dispatch 按 CorrelationId 把回复和被退回的请求交给 Call, channel 关闭后唤醒所有等待的 Call
+func (c *RPCClient) dispatch(ch *amqp.Channel, replies <-chan amqp.Delivery, returns <-chan amqp.Return) {
+	for replies != nil || returns != nil {
+		var r rpcReply
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			r.d.CorrelationId = ret.CorrelationId
+			r.returned = &ret
+		case d, ok := <-replies:
+			if !ok {
+				replies = nil
+				continue
+			}
+			r.d = d
+		}
+
+		c.mu.Lock()
+		reply := c.pending[r.d.CorrelationId]
+		delete(c.pending, r.d.CorrelationId)
+		c.mu.Unlock()
+		if reply != nil {
+			reply <- r
+		}
+	}
+
+	c.mu.Lock()
+	if c.ch == ch {
+		c.ch = nil
+	}
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+}
+
+// RPCHandler rpc 服务端处理函数, 返回的 error 会作为 *RPCError 回复给客户端
+type RPCHandler func(d *amqp.Delivery) ([]byte, error)
+
+// RPCServer rpc 服务端, 消费 Queue 中的请求, 调用 Handler 后回复到请求的 ReplyTo
+type RPCServer struct {
+	URL  string
+	Conn *Conn // 不为空时代替 URL
+
+	Queue       string
+	Exchanges   []Exchange
+	Bindings    []Binding
+	Concurrency int // 默认 1
+
+	Handler RPCHandler
+}
+
+// Run 处理请求直到 ctx 取消, 与 RabComsumer.Run 一样会自动重连
+func (s *RPCServer) Run(ctx context.Context) error {
+	if s.Handler == nil {
+		return errors.New("rabbitmq rpc Handler is nil")
+	}
+	conn := s.Conn
+	if conn == nil {
+		conn = &Conn{URL: s.URL}
+		defer conn.Close()
+	}
+	p := &RabProducer{Conn: conn}
+	defer p.Close()
+
+	c := &RabComsumer{
+		Conn:        conn,
+		Queue:       s.Queue,
+		Exchanges:   s.Exchanges,
+		Bindings:    s.Bindings,
+		Concurrency: s.Concurrency,
+		Handler: HandlerFunc(func(d *amqp.Delivery) error {
+			return s.reply(p, d)
+		}),
+	}
+	return c.Run(ctx)
+}
+
+// reply 调用 Handler 并回复, 只有回复发送失败时返回 error, 请求会重新入队
+// 回复不使用 Run 的 ctx, 否则关闭时已经处理完的请求会因为回复被取消而重新入队
+func (s *RPCServer) reply(p *RabProducer, d *amqp.Delivery) error {
+	if d.ReplyTo == "" {
+		fmt.Printf("[WARN] rabbitmq rpc queue:%s request without reply_to\n", s.Queue)
+		return nil
+	}
+	body, err := s.call(d)
+	msg := &Message{
+		RoutingKey:    d.ReplyTo,
+		Body:          body,
+		Transient:     true,
+		CorrelationId: d.CorrelationId,
+	}
+	if err != nil {
+		msg.Headers = amqp.Table{HeaderRPCError: err.Error()}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.confirmTimeout())
+	defer cancel()
+	return p.Publish(ctx, msg)
+}
+
+func (s *RPCServer) call(d *amqp.Delivery) (body []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.Handler(d)
+}
@@ -0,0 +1,112 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRPC_Call(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls int32
+	s := &RPCServer{
+		URL:   b.URL(),
+		Queue: "rpc",
+		Handler: func(d *amqp.Delivery) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			if string(d.Body) == "bad" {
+				return nil, errors.New("bad request")
+			}
+			return []byte(strings.ToUpper(string(d.Body))), nil
+		},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+	waitFor(t, "rpc server", func() bool { return b.Consumers("rpc") == 1 })
+
+	c := &RPCClient{URL: b.URL(), Timeout: 3 * time.Second}
+	defer c.Close()
+	reply, err := c.Call(context.Background(), "rpc", []byte("hello"))
+	if err != nil || string(reply) != "HELLO" {
+		t.Fatalf("call: %q %v", reply, err)
+	}
+	if _, err := c.Call(context.Background(), "rpc", []byte("bad")); err == nil || err.(*RPCError).Message != "bad request" {
+		t.Fatalf("call bad: %v, want *RPCError", err)
+	}
+	if _, err := c.Call(context.Background(), "missing", []byte("hello")); err == nil {
+		t.Fatal("call missing queue succeeded")
+	} else if _, ok := err.(*ReturnError); !ok {
+		t.Fatalf("call missing queue: %v, want *ReturnError", err)
+	}
+
+	// 已经超时的请求不发送
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	if _, err := c.Call(expired, "rpc", []byte("late")); err == nil {
+		t.Fatal("call with expired ctx succeeded")
+	}
+	if _, err := c.Call(context.Background(), "rpc", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("server handled %d calls, want 3", n)
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRPCServer_Shutdown(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	s := &RPCServer{
+		URL:   b.URL(),
+		Queue: "rpc",
+		Handler: func(d *amqp.Delivery) ([]byte, error) {
+			close(handling)
+			<-release
+			return d.Body, nil
+		},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+	waitFor(t, "rpc server", func() bool { return b.Consumers("rpc") == 1 })
+
+	c := &RPCClient{URL: b.URL(), Timeout: 3 * time.Second}
+	defer c.Close()
+	replyc := make(chan error, 1)
+	go func() {
+		_, err := c.Call(context.Background(), "rpc", []byte("hello"))
+		replyc <- err
+	}()
+
+	// 关闭时正在处理的请求仍要回复并 ack, 不能重新入队
+	<-handling
+	cancel()
+	close(release)
+	if err := <-replyc; err != nil {
+		t.Fatalf("call during shutdown: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if ready := b.Ready("rpc"); len(ready) != 0 {
+		t.Fatalf("requests requeued %v", ready)
+	}
+}
@@ -0,0 +1,44 @@
+package rabbitmq
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// Exchange 交换机, 总是 durable; Passive 为 true 时只校验交换机存在, 不创建
+type Exchange struct {
+	Name    string
+	Kind    string // amqp.ExchangeDirect / ExchangeTopic / ExchangeFanout / ExchangeHeaders, 默认 direct
+	Passive bool
+	Args    amqp.Table
+}
+
+// Binding 把队列绑定到交换机
+type Binding struct {
+	Exchange   string
+	RoutingKey string
+	Args       amqp.Table
+}
+
+func (e Exchange) declare(ch *amqp.Channel) error {
+	kind := e.Kind
+	if kind == "" {
+		kind = amqp.ExchangeDirect
+	}
+	if e.Passive {
+		return ch.ExchangeDeclarePassive(e.Name, kind, true, false, false, false, e.Args)
+	}
+	return ch.ExchangeDeclare(e.Name, kind, true, false, false, false, e.Args)
+}
+
+// declareQueue 声明 durable 队列并绑定到交换机, 交换机需要已经存在
+func declareQueue(ch *amqp.Channel, queue string, args amqp.Table, bindings []Binding) error {
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, args); err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		if err := ch.QueueBind(queue, b.RoutingKey, b.Exchange, false, b.Args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
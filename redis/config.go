@@ -0,0 +1,177 @@
+package redis
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Config redis config
+type Config struct {
+	Addr     string // host:port, IPv6 as [::1]:6379
+	Password string
+	DB       int // cluster only support db 0
+
+	// MasterName set -> sentinel, Addrs are sentinel addrs;
+	// MasterName empty and Addrs set -> cluster, Addrs are seed nodes
+	MasterName string
+	Addrs      []string
+
+	PoolSize     int           // pool, default 256
+	MinIdleConns int           // pool
+	DialTimeout  time.Duration // default 5s
+	ReadTimeout  time.Duration // default 3s
+	WriteTimeout time.Duration // default ReadTimeout
+	MaxRetries   int           // 0 means no retry
+	TLS          *tls.Config   // nil means no tls
+}
+
+// RegisterRedisConfig register redis by config, single node, sentinel or cluster
+func RegisterRedisConfig(name string, conf *Config) error {
+	if conf == nil {
+		return errors.New("redis config is nil")
+	}
+	// set default on a copy, caller's config unchanged
+	c := *conf
+	if c.PoolSize == 0 {
+		c.PoolSize = 256
+	}
+
+	switch {
+	case c.MasterName != "":
+		if len(c.Addrs) == 0 {
+			return errors.New("redis sentinel addrs required")
+		}
+		return register(name, redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    c.MasterName,
+			SentinelAddrs: c.Addrs,
+			Password:      c.Password,
+			DB:            c.DB,
+			PoolSize:      c.PoolSize,
+			MinIdleConns:  c.MinIdleConns,
+			DialTimeout:   c.DialTimeout,
+			ReadTimeout:   c.ReadTimeout,
+			WriteTimeout:  c.WriteTimeout,
+			MaxRetries:    c.MaxRetries,
+			TLSConfig:     c.TLS,
+		}))
+	case len(c.Addrs) > 0:
+		return register(name, redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        c.Addrs,
+			Password:     c.Password,
+			PoolSize:     c.PoolSize,
+			MinIdleConns: c.MinIdleConns,
+			DialTimeout:  c.DialTimeout,
+			ReadTimeout:  c.ReadTimeout,
+			WriteTimeout: c.WriteTimeout,
+			MaxRetries:   c.MaxRetries,
+			TLSConfig:    c.TLS,
+		}))
+	case c.Addr != "":
+		return register(name, redis.NewClient(&redis.Options{
+			Addr:         c.Addr,
+			Password:     c.Password,
+			DB:           c.DB,
+			PoolSize:     c.PoolSize,
+			MinIdleConns: c.MinIdleConns,
+			DialTimeout:  c.DialTimeout,
+			ReadTimeout:  c.ReadTimeout,
+			WriteTimeout: c.WriteTimeout,
+			MaxRetries:   c.MaxRetries,
+			TLSConfig:    c.TLS,
+		}))
+	}
+	return errors.New("redis addr required")
+}
+
+// ParseURL parse redis://[:password@]host[:port][/db][?pool_size=&min_idle_conns=&dial_timeout=&read_timeout=&write_timeout=&max_retries=]
+// rediss:// enable tls, timeouts use time.ParseDuration format, e.g. 500ms
+func ParseURL(rawurl string) (*Config, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.TLS = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, errors.New("redis url scheme must be redis or rediss")
+	}
+
+	if u.Hostname() == "" {
+		return nil, errors.New("redis url host required")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	c.Addr = net.JoinHostPort(u.Hostname(), port)
+
+	if u.User != nil {
+		c.Password, _ = u.User.Password()
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.DB, err = strconv.Atoi(db); err != nil {
+			return nil, errors.New("redis url db must be a number")
+		}
+	}
+
+	q := u.Query()
+	ints := map[string]*int{
+		"pool_size":      &c.PoolSize,
+		"min_idle_conns": &c.MinIdleConns,
+		"max_retries":    &c.MaxRetries,
+	}
+	for k, p := range ints {
+		if v := q.Get(k); v != "" {
+			if *p, err = strconv.Atoi(v); err != nil {
+				return nil, errors.New("redis url " + k + " must be a number")
+			}
+		}
+	}
+	durations := map[string]*time.Duration{
+		"dial_timeout":  &c.DialTimeout,
+		"read_timeout":  &c.ReadTimeout,
+		"write_timeout": &c.WriteTimeout,
+	}
+	for k, p := range durations {
+		if v := q.Get(k); v != "" {
+			if *p, err = time.ParseDuration(v); err != nil {
+				return nil, errors.New("redis url " + k + " must be a duration")
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// ParseDSN parse old dsn format host:port:pwd, the password may contain ':'
+// use ParseURL for IPv6 addresses
+func ParseDSN(dsn string) (*Config, error) {
+	t := strings.SplitN(dsn, ":", 3)
+
+	c := &Config{}
+	switch {
+	case dsn == "":
+		return nil, errors.New("redis dsn format error")
+	case len(t) == 3:
+		c.Addr = strings.Join(t[:2], ":")
+		c.Password = t[2]
+	case len(t) == 2:
+		c.Addr = dsn
+	default:
+		c.Addr = dsn + ":6379"
+	}
+
+	return c, nil
+}
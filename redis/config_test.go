@@ -0,0 +1,61 @@
+package redis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseURL(t *testing.T) {
+	c, err := ParseURL("rediss://:p:w@d@[::1]:6380/2?pool_size=10&min_idle_conns=2&read_timeout=500ms&max_retries=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != "[::1]:6380" || c.Password != "p:w@d" || c.DB != 2 || c.TLS == nil {
+		t.Fatalf("config %+v", c)
+	}
+	if c.PoolSize != 10 || c.MinIdleConns != 2 || c.ReadTimeout != 500*time.Millisecond || c.MaxRetries != 3 {
+		t.Fatalf("config options %+v", c)
+	}
+
+	c, err = ParseURL("redis://127.0.0.1")
+	if err != nil || c.Addr != "127.0.0.1:6379" || c.TLS != nil {
+		t.Fatalf("config %+v err %v", c, err)
+	}
+	if _, err := ParseURL("http://127.0.0.1"); err == nil {
+		t.Fatal("scheme http accepted")
+	}
+}
+
+func TestParseDSN(t *testing.T) {
+	for dsn, want := range map[string]Config{
+		"127.0.0.1:6379:pw:d": {Addr: "127.0.0.1:6379", Password: "pw:d"},
+		"127.0.0.1:6380":      {Addr: "127.0.0.1:6380"},
+		"127.0.0.1":           {Addr: "127.0.0.1:6379"},
+	} {
+		c, err := ParseDSN(dsn)
+		if err != nil || c.Addr != want.Addr || c.Password != want.Password {
+			t.Fatalf("dsn %s config %+v err %v", dsn, c, err)
+		}
+	}
+}
+
+func TestRegisterRedisConfig(t *testing.T) {
+	if err := RegisterRedisConfig("nil", nil); err == nil {
+		t.Fatal("register nil config succeeded")
+	}
+
+	// nothing listens on port 1, ping fails but client is registered with defaults
+	c := &Config{Addr: "127.0.0.1:1", DialTimeout: 10 * time.Millisecond}
+	RegisterRedisConfig("config_test", c)
+	client := Client("config_test")
+	if client == nil {
+		t.Fatal("client not registered")
+	}
+	defer client.Close()
+	if client.Options().PoolSize != 256 {
+		t.Fatalf("pool size %d, want default 256", client.Options().PoolSize)
+	}
+	if c.PoolSize != 0 {
+		t.Fatalf("caller config changed, pool size %d", c.PoolSize)
+	}
+}
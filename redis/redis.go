@@ -10,44 +10,62 @@ import (
 var redisConfig = sync.Map{}
 
 // RegisterRedis register redis
-// dsn format -> host:port:pwd, using ':' to split
+// dsn format -> redis://[:password@]host[:port][/db][?options], see ParseURL
+// or the old format host:port:pwd, using ':' to split, see ParseDSN
 func RegisterRedis(name string, dsn string) error {
-	t := strings.Split(dsn, ":")
+	var c *Config
+	var err error
+	if strings.HasPrefix(dsn, "redis://") || strings.HasPrefix(dsn, "rediss://") {
+		c, err = ParseURL(dsn)
+	} else {
+		c, err = ParseDSN(dsn)
+	}
+	if err != nil {
+		return err
+	}
 
-	var addr, pwd string
+	return RegisterRedisConfig(name, c)
+}
 
-	switch {
-	case len(t) == 3:
-		addr = strings.Join(t[:2], ":")
-		pwd = t[2]
-	case len(t) == 2:
-		addr = dsn
-	case len(t) == 1:
-		addr = dsn + ":6379"
-	default:
-		return errors.New("redis dsn format error")
+// RegisterSentinel register redis behind sentinel, master is the sentinel master name
+func RegisterSentinel(name string, master string, sentinelAddrs []string, pwd string) error {
+	if master == "" || len(sentinelAddrs) == 0 {
+		return errors.New("redis sentinel master and addrs required")
 	}
 
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: pwd, // no password set
-		DB:       0,   // use default DB
-		PoolSize: 256,
-	})
+	return RegisterRedisConfig(name, &Config{MasterName: master, Addrs: sentinelAddrs, Password: pwd})
+}
+
+// RegisterCluster register redis cluster, addrs is a seed list of cluster nodes
+func RegisterCluster(name string, addrs []string, pwd string) error {
+	if len(addrs) == 0 {
+		return errors.New("redis cluster addrs required")
+	}
+
+	return RegisterRedisConfig(name, &Config{Addrs: addrs, Password: pwd})
+}
 
+// register store client by name
+func register(name string, client redis.UniversalClient) error {
 	redisConfig.Store(name, client)
 
 	return client.Ping().Err()
 }
 
-// Client CloseRedis
+// Client get single node or sentinel client, return nil for cluster, use UniversalClient instead
 func Client(name string) *redis.Client {
+	c, _ := UniversalClient(name).(*redis.Client)
+	return c
+}
+
+// UniversalClient get client registered by RegisterRedis, RegisterSentinel or RegisterCluster
+func UniversalClient(name string) redis.UniversalClient {
 	v, ok := redisConfig.Load(name)
 	if !ok {
 		return nil
 	}
 
-	c, ok := v.(*redis.Client)
+	c, ok := v.(redis.UniversalClient)
 	if !ok {
 		return nil
 	}
@@ -58,10 +76,10 @@ func Client(name string) *redis.Client {
 // CloseAll close all redis
 func CloseAll() error {
 	redisConfig.Range(func(k, v interface{}) bool {
-		if c, ok := v.(*redis.Client); ok && c != nil {
+		if c, ok := v.(redis.UniversalClient); ok && c != nil {
 			c.Close()
 		}
-		return false
+		return true
 	})
 	return nil
 }
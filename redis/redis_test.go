@@ -13,3 +13,13 @@ func TestClient(t *testing.T) {
 func TestCloseAll(t *testing.T) {
 	CloseAll()
 }
+
+func TestRegisterCluster(t *testing.T) {
+	RegisterCluster("cluster", []string{"127.0.0.1:7000", "127.0.0.1:7001"}, "")
+	if UniversalClient("cluster") == nil {
+		t.Fatal("cluster client not registered")
+	}
+	if Client("cluster") != nil {
+		t.Fatal("cluster client is not *redis.Client")
+	}
+}